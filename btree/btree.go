@@ -1,8 +1,10 @@
 package btree
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"sort"
 
 	"github.com/yuya-isaka/chibidb/disk"
 	"github.com/yuya-isaka/chibidb/pool"
@@ -53,7 +55,7 @@ const (
 // バイトスライスをdisk.PageIDに変換
 func toPageID(b []byte) disk.PageID {
 	if len(b) != 8 {
-		return disk.InvalidPageID
+		return disk.InvalidID
 	}
 	// binary.LittleEndianで符号なし64ビット整数に変換
 	return disk.PageID(binary.LittleEndian.Uint64(b))
@@ -89,7 +91,7 @@ type Meta struct {
 // rootIDも設定する
 func NewMeta(page *pool.Page) (*Meta, error) {
 	// 4096 bytes のページデータを取得
-	pageData := page.GetPageData()
+	pageData := page.GetData()
 	if len(pageData) != disk.PageSize {
 		return nil, fmt.Errorf("invalid page size: got %d, want %d", len(pageData), disk.PageSize)
 	}
@@ -107,7 +109,7 @@ func (m *Meta) GetRootID() disk.PageID {
 }
 
 func (m *Meta) SetRootID(rootID disk.PageID) error {
-	if rootID <= disk.InvalidPageID {
+	if rootID <= disk.InvalidID {
 		return fmt.Errorf("invalid page id: got %d", rootID)
 	}
 	copy(m.header.rootID, to8Bytes(rootID))
@@ -127,7 +129,7 @@ type Node struct {
 
 func NewNode(page *pool.Page) (*Node, error) {
 	// 4096 bytes のページデータを取得
-	pageData := page.GetPageData()
+	pageData := page.GetData()
 	if len(pageData) != disk.PageSize {
 		return nil, fmt.Errorf("invalid page size: got %d, want %d", len(pageData), disk.PageSize)
 	}
@@ -154,12 +156,22 @@ func (n *Node) SetNodeType(nodeType NodeType) {
 
 // ======================================================================
 
+// スロット配列（ポインタ配列）1エントリのサイズ
+const pointerSize = 2
+
+// セルのヘッダー（keyLen, valLen）のサイズ
+const cellHeaderSize = 4
+
 type SlotHeader struct {
 	numSlot   []byte // 2 bytes, uint16
 	freeSpace []byte // 2 bytes, uint16
 }
 
 // 4072 bytes (Leafのbodyのサイズ) or 4080 bytes (Branchのbodyのサイズ)
+//
+// bodyの先頭からスロット数分のポインタ配列（各エントリの開始オフセット）が並び、
+// セル本体（[keyLen][valLen][key][value]）はbodyの末尾から詰めて格納する。
+// ポインタ配列の末尾とセル領域の先頭の間が連続した空きスペースになる。
 type Slot struct {
 	header SlotHeader // 4 bytes
 	body   []byte     // 4068 bytes (Leaf) or 4076 bytes (Branch)
@@ -171,6 +183,222 @@ func (s *Slot) reset() {
 	copy(s.header.freeSpace, to2Bytes(uint16(len(s.body))))
 }
 
+func (s *Slot) getNumSlot() uint16 {
+	return binary.LittleEndian.Uint16(s.header.numSlot)
+}
+
+func (s *Slot) setNumSlot(n uint16) {
+	binary.LittleEndian.PutUint16(s.header.numSlot, n)
+}
+
+func (s *Slot) getFreeSpace() uint16 {
+	return binary.LittleEndian.Uint16(s.header.freeSpace)
+}
+
+func (s *Slot) setFreeSpace(n uint16) {
+	binary.LittleEndian.PutUint16(s.header.freeSpace, n)
+}
+
+func (s *Slot) pointerAt(i int) uint16 {
+	off := i * pointerSize
+	return binary.LittleEndian.Uint16(s.body[off : off+pointerSize])
+}
+
+func (s *Slot) setPointerAt(i int, offset uint16) {
+	off := i * pointerSize
+	binary.LittleEndian.PutUint16(s.body[off:off+pointerSize], offset)
+}
+
+// offsetにあるセルからkeyとvalueを取り出す
+func (s *Slot) cellAt(offset uint16) (key, value []byte) {
+	keyLen := binary.LittleEndian.Uint16(s.body[offset : offset+2])
+	valLen := binary.LittleEndian.Uint16(s.body[offset+2 : offset+4])
+	key = s.body[offset+4 : offset+4+keyLen]
+	value = s.body[offset+4+keyLen : offset+4+keyLen+valLen]
+	return key, value
+}
+
+func (s *Slot) getAt(idx int) (key, value []byte) {
+	return s.cellAt(s.pointerAt(idx))
+}
+
+// ポインタ配列の末尾とセル領域の先頭の間の、連続した空きスペースを求める。
+// 削除によって生じた穴はここには含まれない（compactするまで再利用できない）
+func (s *Slot) contiguousFree() uint16 {
+	n := int(s.getNumSlot())
+
+	cellStart := uint16(len(s.body))
+	for i := 0; i < n; i++ {
+		if off := s.pointerAt(i); off < cellStart {
+			cellStart = off
+		}
+	}
+
+	dirEnd := uint16(n) * pointerSize
+	if cellStart < dirEnd {
+		return 0
+	}
+	return cellStart - dirEnd
+}
+
+// keyを二分探索する。見つかればそのインデックスとtrueを、
+// 見つからなければ挿入すべきインデックスとfalseを返す
+func (s *Slot) search(key []byte) (int, bool) {
+	n := int(s.getNumSlot())
+
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		k, _ := s.getAt(mid)
+		switch bytes.Compare(k, key) {
+		case 0:
+			return mid, true
+		case -1:
+			lo = mid + 1
+		default:
+			hi = mid
+		}
+	}
+
+	return lo, false
+}
+
+// keyが既に存在すれば上書きし、存在しなければ挿入する。
+// 空きスペースが足りない場合はfalseを返す（呼び出し側でノード分割を行う）
+func (s *Slot) insert(key, value []byte) bool {
+	cellLen := uint16(cellHeaderSize + len(key) + len(value))
+	need := cellLen + pointerSize
+
+	idx, found := s.search(key)
+
+	if found {
+		_, oldValue := s.getAt(idx)
+		if len(oldValue) == len(value) {
+			copy(oldValue, value)
+			return true
+		}
+		// サイズが変わるので一度消してから入れ直す
+		s.deleteAt(idx)
+	}
+
+	if s.contiguousFree() < need {
+		s.compact()
+	}
+	if s.contiguousFree() < need {
+		return false
+	}
+
+	s.insertAt(idx, key, value, cellLen)
+	return true
+}
+
+func (s *Slot) insertAt(idx int, key, value []byte, cellLen uint16) {
+	n := int(s.getNumSlot())
+
+	cellStart := uint16(len(s.body))
+	for i := 0; i < n; i++ {
+		if off := s.pointerAt(i); off < cellStart {
+			cellStart = off
+		}
+	}
+
+	offset := cellStart - cellLen
+	binary.LittleEndian.PutUint16(s.body[offset:offset+2], uint16(len(key)))
+	binary.LittleEndian.PutUint16(s.body[offset+2:offset+4], uint16(len(value)))
+	copy(s.body[offset+4:offset+4+uint16(len(key))], key)
+	copy(s.body[offset+4+uint16(len(key)):offset+cellLen], value)
+
+	for i := n; i > idx; i-- {
+		s.setPointerAt(i, s.pointerAt(i-1))
+	}
+	s.setPointerAt(idx, offset)
+
+	s.setNumSlot(uint16(n + 1))
+	s.setFreeSpace(s.getFreeSpace() - cellLen - pointerSize)
+}
+
+// idx番目のエントリを削除する。空いたセル領域は穴として残り、
+// freeSpaceだけが増える（物理的な再利用はcompactが行う）
+func (s *Slot) deleteAt(idx int) {
+	n := int(s.getNumSlot())
+
+	offset := s.pointerAt(idx)
+	keyLen := binary.LittleEndian.Uint16(s.body[offset : offset+2])
+	valLen := binary.LittleEndian.Uint16(s.body[offset+2 : offset+4])
+	cellLen := uint16(cellHeaderSize) + keyLen + valLen
+
+	for i := idx; i < n-1; i++ {
+		s.setPointerAt(i, s.pointerAt(i+1))
+	}
+
+	s.setNumSlot(uint16(n - 1))
+	s.setFreeSpace(s.getFreeSpace() + cellLen + pointerSize)
+}
+
+// 生きているセルをbodyの末尾に詰め直し、削除によって生じた穴を回収する
+func (s *Slot) compact() {
+	n := int(s.getNumSlot())
+
+	type cell struct {
+		key []byte
+		val []byte
+	}
+
+	cells := make([]cell, n)
+	for i := 0; i < n; i++ {
+		k, v := s.getAt(i)
+		cells[i] = cell{key: append([]byte(nil), k...), val: append([]byte(nil), v...)}
+	}
+
+	end := uint16(len(s.body))
+	for i, c := range cells {
+		cellLen := uint16(cellHeaderSize + len(c.key) + len(c.val))
+		offset := end - cellLen
+		binary.LittleEndian.PutUint16(s.body[offset:offset+2], uint16(len(c.key)))
+		binary.LittleEndian.PutUint16(s.body[offset+2:offset+4], uint16(len(c.val)))
+		copy(s.body[offset+4:offset+4+uint16(len(c.key))], c.key)
+		copy(s.body[offset+4+uint16(len(c.key)):offset+cellLen], c.val)
+		s.setPointerAt(i, offset)
+		end = offset
+	}
+
+	s.setFreeSpace(end - uint16(n)*pointerSize)
+}
+
+// キーと値の組。ノードの再構築（分割など）で使う中間表現
+type kv struct {
+	key   []byte
+	value []byte
+}
+
+// スロットの全エントリをキー順に取り出す（分割や昇格でノードを作り直すときに使う）
+func collectSlot(s *Slot) []kv {
+	n := int(s.getNumSlot())
+	out := make([]kv, n)
+	for i := 0; i < n; i++ {
+		k, v := s.getAt(i)
+		out[i] = kv{key: append([]byte(nil), k...), value: append([]byte(nil), v...)}
+	}
+	return out
+}
+
+// entriesはキー順にソート済みである前提。eを適切な位置に挿入する（キーが重複すれば上書き）
+func insertSorted(entries []kv, e kv) []kv {
+	idx := sort.Search(len(entries), func(i int) bool {
+		return bytes.Compare(entries[i].key, e.key) >= 0
+	})
+
+	if idx < len(entries) && bytes.Equal(entries[idx].key, e.key) {
+		entries[idx] = e
+		return entries
+	}
+
+	entries = append(entries, kv{})
+	copy(entries[idx+1:], entries[idx:])
+	entries[idx] = e
+	return entries
+}
+
 // ======================================================================
 
 type LeafHeader struct {
@@ -184,6 +412,7 @@ type Leaf struct {
 	body   Slot       // 4072 bytes
 }
 
+// nodeをLeafとして解釈する。中身はそのままなので、新規作成時はreset()を呼ぶこと
 func NewLeaf(node *Node) (*Leaf, error) {
 	if nodetype(node.header.nodeType) != LeafNodeType {
 		return nil, fmt.Errorf("invalid node type: got %s, want %s", node.header.nodeType, LeafNodeType)
@@ -211,16 +440,13 @@ func NewLeaf(node *Node) (*Leaf, error) {
 		},
 	}
 
-	// 初期化
-	leaf.reset()
-
 	return leaf, nil
 }
 
 func (l *Leaf) reset() {
-	// prevID, nextIDをInvalidPageIDにセット
-	copy(l.header.prevID, to8Bytes(disk.InvalidPageID))
-	copy(l.header.nextID, to8Bytes(disk.InvalidPageID))
+	// prevID, nextIDをInvalidIDにセット
+	copy(l.header.prevID, to8Bytes(disk.InvalidID))
+	copy(l.header.nextID, to8Bytes(disk.InvalidID))
 
 	// スロット数0、空きスペースは全てのボディ
 	l.body.reset()
@@ -230,31 +456,181 @@ func (l *Leaf) GetPrevID() disk.PageID {
 	return toPageID(l.header.prevID)
 }
 
+func (l *Leaf) SetPrevID(id disk.PageID) {
+	copy(l.header.prevID, to8Bytes(id))
+}
+
 func (l *Leaf) GetNextID() disk.PageID {
 	return toPageID(l.header.nextID)
 }
 
+func (l *Leaf) SetNextID(id disk.PageID) {
+	copy(l.header.nextID, to8Bytes(id))
+}
+
 func (l *Leaf) GetNumSlots() uint16 {
-	return binary.LittleEndian.Uint16(l.body.header.numSlot)
+	return l.body.getNumSlot()
 }
 
 func (l *Leaf) GetFreeSpace() uint16 {
-	return binary.LittleEndian.Uint16(l.body.header.freeSpace)
+	return l.body.getFreeSpace()
+}
+
+// 全エントリをキー順に取り出す（分割でノードを作り直すときに使う）
+func (l *Leaf) collect() []kv {
+	return collectSlot(&l.body)
 }
 
 // ======================================================================
 
-// type BranchHeader struct {
-// 	rightID disk.PageID
-// }
+type BranchHeader struct {
+	rightID []byte // 8 bytes
+}
+
+// 4088 bytes (Nodeのbodyのサイズ)
+type Branch struct {
+	header BranchHeader // 8 bytes
+	body   Slot         // 4080 bytes
+}
 
-// type Branch struct {
-// 	header BranchHeader
-// 	body   Slot
-// }
+// nodeをBranchとして解釈する。中身はそのままなので、新規作成時はreset()を呼ぶこと
+func NewBranch(node *Node) (*Branch, error) {
+	if nodetype(node.header.nodeType) != BranchNodeType {
+		return nil, fmt.Errorf("invalid node type: got %s, want %s", node.header.nodeType, BranchNodeType)
+	}
+
+	// 4088 bytes のノードボディを取得
+	nodeBody := node.body
+	if len(nodeBody) != disk.PageSize-8 {
+		return nil, fmt.Errorf("invalid page size: got %d, want %d", len(nodeBody), disk.PageSize-8)
+	}
+
+	branch := &Branch{
+		// 8 bytes
+		header: BranchHeader{
+			rightID: nodeBody[:8],
+		},
+		// 4080 bytes
+		body: Slot{
+			header: SlotHeader{
+				numSlot:   nodeBody[8:10],  // 2 bytes
+				freeSpace: nodeBody[10:12], // 2 bytes
+			},
+			body: nodeBody[12:],
+		},
+	}
+
+	return branch, nil
+}
+
+func (b *Branch) reset() {
+	// rightIDをInvalidIDにセット
+	copy(b.header.rightID, to8Bytes(disk.InvalidID))
+
+	// スロット数0、空きスペースは全てのボディ
+	b.body.reset()
+}
+
+func (b *Branch) GetRightID() disk.PageID {
+	return toPageID(b.header.rightID)
+}
+
+func (b *Branch) SetRightID(id disk.PageID) {
+	copy(b.header.rightID, to8Bytes(id))
+}
+
+// keyを含む子のページIDを返す。スロットはkey[i]未満を子child[i]が担当し、
+// 最大のkey以上はrightIDが担当する
+func (b *Branch) childFor(key []byte) disk.PageID {
+	n := int(b.body.getNumSlot())
+
+	lo, hi := 0, n
+	for lo < hi {
+		mid := (lo + hi) / 2
+		k, _ := b.body.getAt(mid)
+		if bytes.Compare(key, k) < 0 {
+			hi = mid
+		} else {
+			lo = mid + 1
+		}
+	}
+
+	if lo == n {
+		return b.GetRightID()
+	}
+	_, v := b.body.getAt(lo)
+	return toPageID(v)
+}
+
+// oldChildIDを指していたポインタ（rightIDまたはスロットの値）をnewChildIDに向け直す
+func (b *Branch) redirect(oldChildID, newChildID disk.PageID) {
+	if b.GetRightID() == oldChildID {
+		b.SetRightID(newChildID)
+		return
+	}
+
+	n := int(b.body.getNumSlot())
+	for i := 0; i < n; i++ {
+		_, v := b.body.getAt(i)
+		if toPageID(v) == oldChildID {
+			copy(v, to8Bytes(newChildID))
+			return
+		}
+	}
+}
+
+// 全エントリをキー順に取り出す（分割でノードを作り直すときに使う）
+func (b *Branch) collect() []kv {
+	return collectSlot(&b.body)
+}
 
 // ======================================================================
 
+// ノード分割で親に昇格させるキーと、新しくできた右側ノードのページID
+type splitResult struct {
+	key     []byte
+	rightID disk.PageID
+}
+
+// ======================================================================
+
+// Leafのスロット値の先頭1byteに置く種類タグ
+type valueTag byte
+
+const (
+	tagRaw    valueTag = 0x00 // ただのバイト列
+	tagInline valueTag = 0x01 // 親スロットの中に収まる小さなネストしたB+Tree
+	tagPaged  valueTag = 0x02 // 独立したページを持つネストしたB+Tree（MetaHeader{rootID}相当）
+)
+
+// インラインコレクションの値全体（タグを含む）のサイズ。親リーフの1エントリ分に収まる大きさにしておく
+const maxInlineValueSize = 1024
+
+// tagを先頭に付けたバイト列を作る
+func taggedValue(tag valueTag, payload []byte) []byte {
+	out := make([]byte, 1+len(payload))
+	out[0] = byte(tag)
+	copy(out[1:], payload)
+	return out
+}
+
+// tagRawな値からタグを取り除いて返す。コレクション（tagInline/tagPaged）の場合は
+// 通常の値として取り出せないので、見つからなかった場合と同様に(nil, false, nil)を返す
+func untagRaw(tagged []byte) ([]byte, bool, error) {
+	if len(tagged) == 0 {
+		return nil, false, fmt.Errorf("corrupt value: empty")
+	}
+	if valueTag(tagged[0]) != tagRaw {
+		return nil, false, nil
+	}
+	return append([]byte(nil), tagged[1:]...), true, nil
+}
+
+// ======================================================================
+
+// Insert/Search/Delete/Clearはpool.PoolManagerを直接介してページをインプレースで
+// 書き換える。tx.Tx（コピーオンライトのトランザクション）は未経由で、txパッケージの
+// 「書き込みはページをインプレースで書き換えない」という保証はBTreeには及んでいない
 type BTree struct {
 	metaID disk.PageID // メタデータのページID
 }
@@ -291,6 +667,7 @@ func NewBTree(poolManager *pool.PoolManager) (*BTree, error) {
 	if err = metaData.SetRootID(rootID); err != nil {
 		return nil, err
 	}
+	metaPage.SetUpdate(true)
 
 	// ルートページからルートノード取得
 	rootNode, err := NewNode(rootPage)
@@ -301,10 +678,12 @@ func NewBTree(poolManager *pool.PoolManager) (*BTree, error) {
 	rootNode.SetNodeType(LeafNodeType)
 
 	// ルートノードからリーフノード取得と初期化
-	_, err = NewLeaf(rootNode)
+	rootLeaf, err := NewLeaf(rootNode)
 	if err != nil {
 		return nil, err
 	}
+	rootLeaf.reset()
+	rootPage.SetUpdate(true)
 
 	return &BTree{
 		metaID: metaID, // メタデータのページIDはここでセットするから、SetMetaID()は不要
@@ -315,30 +694,828 @@ func (b *BTree) GetMetaID() disk.PageID {
 	return b.metaID
 }
 
-// BTreeによって確保されているページを全てアンピンし、メタデータのページIDを無効値にする
+// BTreeによって確保されているページをアンピンしてフリーリストに戻し、メタデータのページIDを無効値にする。
+// Delete同様マージを行わないため、キーの挿入によって枝分かれしたページはここでは解放されない
 func (b *BTree) Clear(poolManager *pool.PoolManager) error {
 	metaPage, err := poolManager.FetchPage(b.metaID)
 	if err != nil {
 		return err
 	}
-	// ここで作成したページとBtree作成時に作ったページをアンピン
-	defer metaPage.Unpin()
-	defer metaPage.Unpin()
 
 	metaData, err := NewMeta(metaPage)
+	if err != nil {
+		metaPage.SubPin()
+		return err
+	}
+	rootID := metaData.GetRootID()
+
+	rootPage, err := poolManager.FetchPage(rootID)
+	if err != nil {
+		metaPage.SubPin()
+		return err
+	}
+
+	metaID := b.metaID
+	b.metaID = disk.InvalidID
+
+	// FreePageはフレームのピンを無条件に外すので、先にアンピンを済ませてから解放する。
+	// ここで作成したページとBtree作成時に作ったページの両方をアンピンする
+	rootPage.SubPin()
+	rootPage.SubPin()
+	if err := poolManager.FreePage(rootID); err != nil {
+		metaPage.SubPin()
+		return err
+	}
+
+	metaPage.SubPin()
+	metaPage.SubPin()
+	return poolManager.FreePage(metaID)
+}
+
+// ======================================================================
+
+// keyに対応する値を探索する
+func (b *BTree) Search(pm *pool.PoolManager, key []byte) ([]byte, bool, error) {
+	metaPage, err := pm.FetchPage(b.metaID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer metaPage.SubPin()
+
+	meta, err := NewMeta(metaPage)
+	if err != nil {
+		return nil, false, err
+	}
+
+	tagged, found, err := searchNode(pm, meta.GetRootID(), key)
+	if err != nil || !found {
+		return nil, found, err
+	}
+
+	return untagRaw(tagged)
+}
+
+func searchNode(pm *pool.PoolManager, id disk.PageID, key []byte) ([]byte, bool, error) {
+	page, err := pm.FetchPage(id)
+	if err != nil {
+		return nil, false, err
+	}
+	defer page.SubPin()
+
+	node, err := NewNode(page)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch node.GetNodeType() {
+	case LeafNodeType:
+		leaf, err := NewLeaf(node)
+		if err != nil {
+			return nil, false, err
+		}
+
+		idx, found := leaf.body.search(key)
+		if !found {
+			return nil, false, nil
+		}
+		_, value := leaf.body.getAt(idx)
+		return append([]byte(nil), value...), true, nil
+
+	case BranchNodeType:
+		branch, err := NewBranch(node)
+		if err != nil {
+			return nil, false, err
+		}
+		return searchNode(pm, branch.childFor(key), key)
+
+	default:
+		return nil, false, fmt.Errorf("unknown node type: %v", node.GetNodeType())
+	}
+}
+
+// ======================================================================
+
+// keyとvalueを挿入する。既にkeyが存在する場合は上書きする
+func (b *BTree) Insert(pm *pool.PoolManager, key, value []byte) error {
+	if len(key) == 0 {
+		return fmt.Errorf("key must not be empty")
+	}
+
+	metaPage, err := pm.FetchPage(b.metaID)
+	if err != nil {
+		return err
+	}
+	defer metaPage.SubPin()
+
+	meta, err := NewMeta(metaPage)
+	if err != nil {
+		return err
+	}
+
+	rootID := meta.GetRootID()
+
+	// 既存の値がコレクション(tagInline/tagPaged)なら、CreateCollectionと同じく
+	// 上書きを拒否する。黙って上書きすると、そのコレクションのページドなルートが
+	// 参照を失い、解放もされないまま残り続ける
+	if tagged, found, err := searchNode(pm, rootID, key); err != nil {
+		return err
+	} else if found {
+		if _, ok, err := untagRaw(tagged); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("%q already holds a collection", key)
+		}
+	}
+
+	newRootID, err := insertRoot(pm, rootID, key, taggedValue(tagRaw, value))
+	if err != nil {
+		return err
+	}
+	if newRootID == rootID {
+		return nil
+	}
+
+	if err := meta.SetRootID(newRootID); err != nil {
+		return err
+	}
+	metaPage.SetUpdate(true)
+
+	return nil
+}
+
+// ルートIDがrootIDであるサブツリーにkey, valueを挿入する。
+// ルートが分割された場合は新しいルートのページIDを返す（分割されなければrootIDをそのまま返す）
+func insertRoot(pm *pool.PoolManager, rootID disk.PageID, key, value []byte) (disk.PageID, error) {
+	split, err := insertNode(pm, rootID, key, value)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	if split == nil {
+		return rootID, nil
+	}
+
+	// ルートが分割されたので、新しいルート(Branch)を作って木を1段深くする
+	newRootID, err := pm.CreatePage()
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	newRootPage, err := pm.FetchPage(newRootID)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	defer newRootPage.SubPin()
+
+	newRootNode, err := NewNode(newRootPage)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	newRootNode.SetNodeType(BranchNodeType)
+
+	newRootBranch, err := NewBranch(newRootNode)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	newRootBranch.reset()
+	newRootBranch.SetRightID(split.rightID)
+	if !newRootBranch.body.insert(split.key, to8Bytes(rootID)) {
+		return disk.InvalidID, fmt.Errorf("failed to initialize new root")
+	}
+	newRootPage.SetUpdate(true)
+
+	return newRootID, nil
+}
+
+// idのノードにkey, valueを挿入する。ノードが分割された場合はその結果を返す
+func insertNode(pm *pool.PoolManager, id disk.PageID, key, value []byte) (*splitResult, error) {
+	page, err := pm.FetchPage(id)
+	if err != nil {
+		return nil, err
+	}
+	defer page.SubPin()
+
+	node, err := NewNode(page)
+	if err != nil {
+		return nil, err
+	}
+
+	switch node.GetNodeType() {
+	case LeafNodeType:
+		leaf, err := NewLeaf(node)
+		if err != nil {
+			return nil, err
+		}
+
+		if leaf.body.insert(key, value) {
+			page.SetUpdate(true)
+			return nil, nil
+		}
+
+		return splitLeaf(pm, id, page, leaf, key, value)
+
+	case BranchNodeType:
+		branch, err := NewBranch(node)
+		if err != nil {
+			return nil, err
+		}
+
+		childID := branch.childFor(key)
+		split, err := insertNode(pm, childID, key, value)
+		if err != nil {
+			return nil, err
+		}
+		if split == nil {
+			return nil, nil
+		}
+
+		// 子が分割された。childIDを指していたポインタを新しい右側の子に向け直し、
+		// 元の子(左側、childID)を指すセパレータキーを挿入する
+		branch.redirect(childID, split.rightID)
+
+		if branch.body.insert(split.key, to8Bytes(childID)) {
+			page.SetUpdate(true)
+			return nil, nil
+		}
+
+		return splitBranch(pm, id, page, branch, split.key, childID)
+
+	default:
+		return nil, fmt.Errorf("unknown node type: %v", node.GetNodeType())
+	}
+}
+
+// リーフが満杯のときに呼ばれる。新しい右側のリーフを作り、既存のエントリと
+// 挿入予定のエントリをキー順に半分ずつ振り分け、兄弟リンクをつなぎ直す
+func splitLeaf(pm *pool.PoolManager, id disk.PageID, page *pool.Page, leaf *Leaf, key, value []byte) (*splitResult, error) {
+	entries := insertSorted(leaf.collect(), kv{key: key, value: value})
+	mid := len(entries) / 2
+
+	newID, err := pm.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	newPage, err := pm.FetchPage(newID)
+	if err != nil {
+		return nil, err
+	}
+	defer newPage.SubPin()
+
+	newNode, err := NewNode(newPage)
+	if err != nil {
+		return nil, err
+	}
+	newNode.SetNodeType(LeafNodeType)
+
+	newLeaf, err := NewLeaf(newNode)
+	if err != nil {
+		return nil, err
+	}
+	newLeaf.reset()
+
+	leaf.body.reset()
+	for _, e := range entries[:mid] {
+		if !leaf.body.insert(e.key, e.value) {
+			return nil, fmt.Errorf("failed to rebuild left leaf after split")
+		}
+	}
+	for _, e := range entries[mid:] {
+		if !newLeaf.body.insert(e.key, e.value) {
+			return nil, fmt.Errorf("failed to rebuild right leaf after split")
+		}
+	}
+
+	// 兄弟リンクをつなぎ直す
+	oldNext := leaf.GetNextID()
+	newLeaf.SetPrevID(id)
+	newLeaf.SetNextID(oldNext)
+	leaf.SetNextID(newID)
+
+	if oldNext != disk.InvalidID {
+		nextPage, err := pm.FetchPage(oldNext)
+		if err != nil {
+			return nil, err
+		}
+		nextNode, err := NewNode(nextPage)
+		if err != nil {
+			nextPage.SubPin()
+			return nil, err
+		}
+		nextLeaf, err := NewLeaf(nextNode)
+		if err != nil {
+			nextPage.SubPin()
+			return nil, err
+		}
+		nextLeaf.SetPrevID(newID)
+		nextPage.SetUpdate(true)
+		nextPage.SubPin()
+	}
+
+	page.SetUpdate(true)
+	newPage.SetUpdate(true)
+
+	separator, _ := newLeaf.body.getAt(0)
+	return &splitResult{key: append([]byte(nil), separator...), rightID: newID}, nil
+}
+
+// ブランチが満杯のときに呼ばれる。(key, childID)を含めた全エントリをキー順に半分ずつ
+// 振り分け、真ん中のキーを呼び出し側（親）に昇格させる
+func splitBranch(pm *pool.PoolManager, id disk.PageID, page *pool.Page, branch *Branch, key []byte, childID disk.PageID) (*splitResult, error) {
+	combined := insertSorted(branch.collect(), kv{key: key, value: to8Bytes(childID)})
+	mid := len(combined) / 2
+	promoted := combined[mid]
+
+	oldRightID := branch.GetRightID()
+
+	newID, err := pm.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	newPage, err := pm.FetchPage(newID)
+	if err != nil {
+		return nil, err
+	}
+	defer newPage.SubPin()
+
+	newNode, err := NewNode(newPage)
+	if err != nil {
+		return nil, err
+	}
+	newNode.SetNodeType(BranchNodeType)
+
+	newBranch, err := NewBranch(newNode)
+	if err != nil {
+		return nil, err
+	}
+	newBranch.reset()
+	newBranch.SetRightID(oldRightID)
+	for _, e := range combined[mid+1:] {
+		if !newBranch.body.insert(e.key, e.value) {
+			return nil, fmt.Errorf("failed to rebuild right branch after split")
+		}
+	}
+
+	branch.body.reset()
+	branch.SetRightID(toPageID(promoted.value))
+	for _, e := range combined[:mid] {
+		if !branch.body.insert(e.key, e.value) {
+			return nil, fmt.Errorf("failed to rebuild left branch after split")
+		}
+	}
+
+	page.SetUpdate(true)
+	newPage.SetUpdate(true)
+
+	return &splitResult{key: append([]byte(nil), promoted.key...), rightID: newID}, nil
+}
+
+// ======================================================================
+
+// keyに対応するエントリを削除する。
+//
+// リーフ/ブランチの間でのマージや再配分は行わない。そのためエントリを消しても、
+// それを収めていたページが空（もしくはアンダーフロー状態）になるだけで、ページ自体は
+// 解放されずツリーに残り続ける。ページが実際にフリーリストへ戻るのはClearを呼んだときと、
+// tx側のコミット/ロールバックでの付け替えだけである
+func (b *BTree) Delete(pm *pool.PoolManager, key []byte) error {
+	metaPage, err := pm.FetchPage(b.metaID)
 	if err != nil {
 		return err
 	}
+	defer metaPage.SubPin()
 
-	rootPage, err := poolManager.FetchPage(metaData.GetRootID())
+	meta, err := NewMeta(metaPage)
 	if err != nil {
 		return err
 	}
-	// ここで作成したページとBtree作成時に作ったページをアンピン
-	defer rootPage.Unpin()
-	defer rootPage.Unpin()
 
-	b.metaID = disk.InvalidPageID
+	return deleteNode(pm, meta.GetRootID(), key)
+}
+
+// マージは行わない。リーフ内のスロットを1つ消すだけで、ページそのものは解放しない
+func deleteNode(pm *pool.PoolManager, id disk.PageID, key []byte) error {
+	page, err := pm.FetchPage(id)
+	if err != nil {
+		return err
+	}
+	defer page.SubPin()
+
+	node, err := NewNode(page)
+	if err != nil {
+		return err
+	}
+
+	switch node.GetNodeType() {
+	case LeafNodeType:
+		leaf, err := NewLeaf(node)
+		if err != nil {
+			return err
+		}
+
+		idx, found := leaf.body.search(key)
+		if !found {
+			return fmt.Errorf("key not found")
+		}
+		leaf.body.deleteAt(idx)
+		page.SetUpdate(true)
+		return nil
+
+	case BranchNodeType:
+		branch, err := NewBranch(node)
+		if err != nil {
+			return err
+		}
+		return deleteNode(pm, branch.childFor(key), key)
+
+	default:
+		return fmt.Errorf("unknown node type: %v", node.GetNodeType())
+	}
+}
+
+// ======================================================================
+
+// Leafのnextリンクを辿って、キー順にエントリを走査するカーソル
+type Cursor struct {
+	pm     *pool.PoolManager
+	leafID disk.PageID
+	idx    int
+}
+
+// key以上の最小のエントリから走査を始めるカーソルを作る
+func (b *BTree) NewCursor(pm *pool.PoolManager, key []byte) (*Cursor, error) {
+	metaPage, err := pm.FetchPage(b.metaID)
+	if err != nil {
+		return nil, err
+	}
+	defer metaPage.SubPin()
+
+	meta, err := NewMeta(metaPage)
+	if err != nil {
+		return nil, err
+	}
+
+	leafID, idx, err := seekLeaf(pm, meta.GetRootID(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cursor{pm: pm, leafID: leafID, idx: idx}, nil
+}
+
+// keyを含む（または含むはずの）リーフのページIDと、そのリーフ内でのインデックスを返す
+func seekLeaf(pm *pool.PoolManager, id disk.PageID, key []byte) (disk.PageID, int, error) {
+	page, err := pm.FetchPage(id)
+	if err != nil {
+		return disk.InvalidID, 0, err
+	}
+	defer page.SubPin()
+
+	node, err := NewNode(page)
+	if err != nil {
+		return disk.InvalidID, 0, err
+	}
+
+	switch node.GetNodeType() {
+	case LeafNodeType:
+		leaf, err := NewLeaf(node)
+		if err != nil {
+			return disk.InvalidID, 0, err
+		}
+		idx, _ := leaf.body.search(key)
+		return id, idx, nil
+
+	case BranchNodeType:
+		branch, err := NewBranch(node)
+		if err != nil {
+			return disk.InvalidID, 0, err
+		}
+		return seekLeaf(pm, branch.childFor(key), key)
+
+	default:
+		return disk.InvalidID, 0, fmt.Errorf("unknown node type: %v", node.GetNodeType())
+	}
+}
+
+// 現在位置のkey, valueを返して1つ進める。末尾に達していればokがfalseになる
+func (c *Cursor) Next() (key, value []byte, ok bool, err error) {
+	page, err := c.pm.FetchPage(c.leafID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	node, err := NewNode(page)
+	if err != nil {
+		page.SubPin()
+		return nil, nil, false, err
+	}
+	leaf, err := NewLeaf(node)
+	if err != nil {
+		page.SubPin()
+		return nil, nil, false, err
+	}
+
+	for c.idx >= int(leaf.body.getNumSlot()) {
+		nextID := leaf.GetNextID()
+		page.SubPin()
+
+		if nextID == disk.InvalidID {
+			return nil, nil, false, nil
+		}
+
+		c.leafID = nextID
+		c.idx = 0
+
+		page, err = c.pm.FetchPage(c.leafID)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		node, err = NewNode(page)
+		if err != nil {
+			page.SubPin()
+			return nil, nil, false, err
+		}
+		leaf, err = NewLeaf(node)
+		if err != nil {
+			page.SubPin()
+			return nil, nil, false, err
+		}
+	}
+
+	k, tagged := leaf.body.getAt(c.idx)
+	raw, ok, err := untagRaw(tagged)
+	if err != nil {
+		page.SubPin()
+		return nil, nil, false, err
+	}
+	if !ok {
+		page.SubPin()
+		return nil, nil, false, fmt.Errorf("%q holds a collection, not a plain value", k)
+	}
+
+	key = append([]byte(nil), k...)
+	value = raw
+	c.idx++
+
+	page.SubPin()
+
+	return key, value, true, nil
+}
+
+// ======================================================================
+
+// 親BTreeのスロット値の中に入れ子として保持される、小さなB+Tree（コレクション）へのハンドル。
+// 中身がインライン表現(tagInline)のうちは専用ページを消費せず、収まらなくなった時点で
+// 自動的にページドな表現(tagPaged)へ昇格する。
+// 親リーフのページIDはキャッシュしない。親BTreeへの挿入で分割が起き、keyが別のページへ
+// 移動しても困らないように、locate()は毎回ルートから辿り直す
+type Collection struct {
+	pm     *pool.PoolManager
+	metaID disk.PageID
+	key    []byte
+}
+
+// keyの位置にインラインの空コレクションを作成する。keyが既に使われている場合はエラー
+func (b *BTree) CreateCollection(pm *pool.PoolManager, key []byte) (*Collection, error) {
+	if len(key) == 0 {
+		return nil, fmt.Errorf("key must not be empty")
+	}
+
+	metaPage, err := pm.FetchPage(b.metaID)
+	if err != nil {
+		return nil, err
+	}
+	defer metaPage.SubPin()
+
+	meta, err := NewMeta(metaPage)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found, err := searchNode(pm, meta.GetRootID(), key); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("%q is already in use", key)
+	}
+
+	tagged := taggedValue(tagInline, make([]byte, maxInlineValueSize-1))
+	wrapInlineSlot(tagged).reset()
+
+	rootID := meta.GetRootID()
+	newRootID, err := insertRoot(pm, rootID, key, tagged)
+	if err != nil {
+		return nil, err
+	}
+	if newRootID != rootID {
+		if err := meta.SetRootID(newRootID); err != nil {
+			return nil, err
+		}
+		metaPage.SetUpdate(true)
+	}
+
+	return &Collection{pm: pm, metaID: b.metaID, key: append([]byte(nil), key...)}, nil
+}
+
+// keyの位置にある既存のコレクションを開く
+func (b *BTree) OpenCollection(pm *pool.PoolManager, key []byte) (*Collection, error) {
+	c := &Collection{pm: pm, metaID: b.metaID, key: append([]byte(nil), key...)}
+
+	page, _, _, tag, _, err := c.locate()
+	if err != nil {
+		return nil, err
+	}
+	page.SubPin()
+
+	if tag != tagInline && tag != tagPaged {
+		return nil, fmt.Errorf("%q is not a collection", key)
+	}
+
+	return c, nil
+}
+
+// ルートから辿り直してc.keyを含む現在の親リーフを取得し、そのスロット値を(タグ付きのまま)返す。
+// 戻り値のpageは呼び出し側でSubPinすること
+func (c *Collection) locate() (*pool.Page, *Leaf, int, valueTag, []byte, error) {
+	metaPage, err := c.pm.FetchPage(c.metaID)
+	if err != nil {
+		return nil, nil, 0, 0, nil, err
+	}
+
+	meta, err := NewMeta(metaPage)
+	if err != nil {
+		metaPage.SubPin()
+		return nil, nil, 0, 0, nil, err
+	}
+	rootID := meta.GetRootID()
+	metaPage.SubPin()
+
+	leafID, _, err := seekLeaf(c.pm, rootID, c.key)
+	if err != nil {
+		return nil, nil, 0, 0, nil, err
+	}
+
+	page, err := c.pm.FetchPage(leafID)
+	if err != nil {
+		return nil, nil, 0, 0, nil, err
+	}
+
+	node, err := NewNode(page)
+	if err != nil {
+		page.SubPin()
+		return nil, nil, 0, 0, nil, err
+	}
+	leaf, err := NewLeaf(node)
+	if err != nil {
+		page.SubPin()
+		return nil, nil, 0, 0, nil, err
+	}
+
+	idx, found := leaf.body.search(c.key)
+	if !found {
+		page.SubPin()
+		return nil, nil, 0, 0, nil, fmt.Errorf("collection not found")
+	}
+
+	_, raw := leaf.body.getAt(idx)
+	return page, leaf, idx, valueTag(raw[0]), raw, nil
+}
+
+// タグを除いたインライン表現のバイト列を、固定サイズのSlotとして解釈する
+func wrapInlineSlot(tagged []byte) *Slot {
+	body := tagged[1:]
+	return &Slot{
+		header: SlotHeader{
+			numSlot:   body[0:2],
+			freeSpace: body[2:4],
+		},
+		body: body[4:],
+	}
+}
+
+func (c *Collection) Insert(key, value []byte) error {
+	page, leaf, _, tag, raw, err := c.locate()
+	if err != nil {
+		return err
+	}
+	defer page.SubPin()
+
+	switch tag {
+	case tagInline:
+		if wrapInlineSlot(raw).insert(key, value) {
+			page.SetUpdate(true)
+			return nil
+		}
+		return c.promote(page, leaf, raw, key, value)
+
+	case tagPaged:
+		rootID := toPageID(raw[1:])
+		newRootID, err := insertRoot(c.pm, rootID, key, value)
+		if err != nil {
+			return err
+		}
+		if newRootID != rootID {
+			if !leaf.body.insert(c.key, taggedValue(tagPaged, to8Bytes(newRootID))) {
+				return fmt.Errorf("failed to update collection root pointer")
+			}
+			page.SetUpdate(true)
+		}
+		return nil
+
+	default:
+		return fmt.Errorf("%q is not a collection", c.key)
+	}
+}
+
+// インライン領域に収まりきらなくなったコレクションを、独立したページを持つ
+// ページドなB+Treeへ昇格させる
+func (c *Collection) promote(page *pool.Page, leaf *Leaf, inlineRaw []byte, key, value []byte) error {
+	entries := insertSorted(collectSlot(wrapInlineSlot(inlineRaw)), kv{key: key, value: value})
+
+	rootID, err := c.pm.CreatePage()
+	if err != nil {
+		return err
+	}
+	rootPage, err := c.pm.FetchPage(rootID)
+	if err != nil {
+		return err
+	}
+	rootNode, err := NewNode(rootPage)
+	if err != nil {
+		rootPage.SubPin()
+		return err
+	}
+	rootNode.SetNodeType(LeafNodeType)
+	rootLeaf, err := NewLeaf(rootNode)
+	if err != nil {
+		rootPage.SubPin()
+		return err
+	}
+	rootLeaf.reset()
+	rootPage.SetUpdate(true)
+	rootPage.SubPin()
+
+	currentRoot := rootID
+	for _, e := range entries {
+		newRoot, err := insertRoot(c.pm, currentRoot, e.key, e.value)
+		if err != nil {
+			return err
+		}
+		currentRoot = newRoot
+	}
+
+	if !leaf.body.insert(c.key, taggedValue(tagPaged, to8Bytes(currentRoot))) {
+		return fmt.Errorf("failed to promote collection to paged subtree")
+	}
+	page.SetUpdate(true)
 
 	return nil
 }
+
+func (c *Collection) Search(key []byte) ([]byte, bool, error) {
+	page, _, _, tag, raw, err := c.locate()
+	if err != nil {
+		return nil, false, err
+	}
+	defer page.SubPin()
+
+	switch tag {
+	case tagInline:
+		inline := wrapInlineSlot(raw)
+		idx, found := inline.search(key)
+		if !found {
+			return nil, false, nil
+		}
+		_, v := inline.getAt(idx)
+		return append([]byte(nil), v...), true, nil
+
+	case tagPaged:
+		return searchNode(c.pm, toPageID(raw[1:]), key)
+
+	default:
+		return nil, false, fmt.Errorf("%q is not a collection", c.key)
+	}
+}
+
+func (c *Collection) Delete(key []byte) error {
+	page, _, _, tag, raw, err := c.locate()
+	if err != nil {
+		return err
+	}
+	defer page.SubPin()
+
+	switch tag {
+	case tagInline:
+		inline := wrapInlineSlot(raw)
+		idx, found := inline.search(key)
+		if !found {
+			return fmt.Errorf("key not found")
+		}
+		inline.deleteAt(idx)
+		page.SetUpdate(true)
+		return nil
+
+	case tagPaged:
+		// Deleteはマージを行わないので、ルートページIDは変わらない
+		return deleteNode(c.pm, toPageID(raw[1:]), key)
+
+	default:
+		return fmt.Errorf("%q is not a collection", c.key)
+	}
+}
@@ -0,0 +1,229 @@
+package btree_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/btree"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+func newTestTree(t *testing.T) (*btree.BTree, *pool.PoolManager) {
+	t.Helper()
+
+	fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poolManager := pool.NewPoolManager(fileManager, pool.NewPool(64))
+	t.Cleanup(func() { poolManager.Close() })
+
+	tree, err := btree.NewBTree(poolManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tree, poolManager
+}
+
+func TestBTreeInsertSearchDelete(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	// 未挿入のキーは見つからない
+	_, found, err := tree.Search(pm, []byte("hello"))
+	assert.NoError(err)
+	assert.False(found)
+
+	assert.NoError(tree.Insert(pm, []byte("hello"), []byte("world")))
+
+	value, found, err := tree.Search(pm, []byte("hello"))
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]byte("world"), value)
+
+	// 同じキーへのInsertは上書き
+	assert.NoError(tree.Insert(pm, []byte("hello"), []byte("there")))
+	value, found, err = tree.Search(pm, []byte("hello"))
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]byte("there"), value)
+
+	assert.NoError(tree.Delete(pm, []byte("hello")))
+	_, found, err = tree.Search(pm, []byte("hello"))
+	assert.NoError(err)
+	assert.False(found)
+
+	// 無いキーのDeleteはエラー
+	assert.Error(tree.Delete(pm, []byte("hello")))
+}
+
+// 1つのリーフに収まらない数のキーを挿入し、リーフ分割・ブランチ分割を跨いでも
+// 全エントリがキー順のまま読み書きできることを確認する
+func TestBTreeSplitAcrossLeavesAndBranches(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	// この値サイズだとリーフ1枚に51件、ブランチ1枚に185件まで入る。順番に挿入すると
+	// リーフは26件ずつ残して分割されるので、ブランチ分割まで起こすには5000件弱が要る
+	const n = 6000
+	value := make([]byte, 64)
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		assert.NoError(tree.Insert(pm, key, value))
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		got, found, err := tree.Search(pm, key)
+		assert.NoError(err)
+		assert.True(found, "key %s should be found", key)
+		assert.Equal(value, got)
+	}
+
+	// カーソルは複数のリーフを跨いでキー順に全件を返す
+	cursor, err := tree.NewCursor(pm, nil)
+	assert.NoError(err)
+
+	count := 0
+	var prevKey []byte
+	for {
+		key, got, ok, err := cursor.Next()
+		assert.NoError(err)
+		if !ok {
+			break
+		}
+		if prevKey != nil {
+			assert.Less(string(prevKey), string(key))
+		}
+		prevKey = key
+		assert.Equal(value, got)
+		count++
+	}
+	assert.Equal(n, count)
+}
+
+func TestBTreeCursorSeeksFromKey(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	for i := 0; i < 200; i++ {
+		key := []byte(fmt.Sprintf("key-%04d", i))
+		assert.NoError(tree.Insert(pm, key, []byte("v")))
+	}
+
+	cursor, err := tree.NewCursor(pm, []byte("key-0150"))
+	assert.NoError(err)
+
+	key, _, ok, err := cursor.Next()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]byte("key-0150"), key)
+}
+
+// CursorはCollectionの入ったキーをタグ付きのまま返さず、収集対象から外してエラーを返す
+func TestBTreeCursorRejectsCollectionEntries(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	assert.NoError(tree.Insert(pm, []byte("a-plain"), []byte("value")))
+	_, err := tree.CreateCollection(pm, []byte("b-collection"))
+	assert.NoError(err)
+
+	cursor, err := tree.NewCursor(pm, nil)
+	assert.NoError(err)
+
+	key, value, ok, err := cursor.Next()
+	assert.NoError(err)
+	assert.True(ok)
+	assert.Equal([]byte("a-plain"), key)
+	assert.Equal([]byte("value"), value)
+
+	_, _, _, err = cursor.Next()
+	assert.Error(err)
+}
+
+// CreateCollectionと同じく、Insertも既存のコレクションを黙って上書きしない
+func TestBTreeInsertRejectsOverwritingACollection(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	_, err := tree.CreateCollection(pm, []byte("coll"))
+	assert.NoError(err)
+
+	err = tree.Insert(pm, []byte("coll"), []byte("oops"))
+	assert.Error(err)
+
+	// 逆に、通常のキーに対してCreateCollectionも上書きできない
+	assert.NoError(tree.Insert(pm, []byte("plain"), []byte("value")))
+	_, err = tree.CreateCollection(pm, []byte("plain"))
+	assert.Error(err)
+}
+
+func TestCollectionInsertSearchDelete(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	coll, err := tree.CreateCollection(pm, []byte("coll"))
+	assert.NoError(err)
+
+	assert.NoError(coll.Insert([]byte("x"), []byte("1")))
+	assert.NoError(coll.Insert([]byte("y"), []byte("2")))
+
+	value, found, err := coll.Search([]byte("x"))
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]byte("1"), value)
+
+	assert.NoError(coll.Delete([]byte("x")))
+	_, found, err = coll.Search([]byte("x"))
+	assert.NoError(err)
+	assert.False(found)
+
+	// 親ツリー側からは、コレクションを保持するキー自体は通常の値としては読めない
+	_, found, err = tree.Search(pm, []byte("coll"))
+	assert.NoError(err)
+	assert.False(found)
+
+	// 既存のコレクションは、後からOpenCollectionで開き直せる
+	reopened, err := tree.OpenCollection(pm, []byte("coll"))
+	assert.NoError(err)
+	value, found, err = reopened.Search([]byte("y"))
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]byte("2"), value)
+
+	// コレクションでないキーをOpenCollectionで開こうとするとエラー
+	assert.NoError(tree.Insert(pm, []byte("plain"), []byte("value")))
+	_, err = tree.OpenCollection(pm, []byte("plain"))
+	assert.Error(err)
+}
+
+// インライン表現に収まりきらなくなったコレクションは、独立したページを持つ
+// ページドな表現へ自動的に昇格する。昇格の前後ですべてのエントリが読めることを確認する
+func TestCollectionPromotesFromInlineToPaged(t *testing.T) {
+	assert := assert.New(t)
+	tree, pm := newTestTree(t)
+
+	coll, err := tree.CreateCollection(pm, []byte("coll"))
+	assert.NoError(err)
+
+	const n = 100
+	value := make([]byte, 32)
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("item-%03d", i))
+		assert.NoError(coll.Insert(key, value))
+	}
+
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("item-%03d", i))
+		got, found, err := coll.Search(key)
+		assert.NoError(err)
+		assert.True(found, "item %s should be found after promotion", key)
+		assert.Equal(value, got)
+	}
+}
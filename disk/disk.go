@@ -1,8 +1,8 @@
 package disk
 
 import (
+	"encoding/binary"
 	"fmt"
-	"io"
 	"os"
 )
 
@@ -15,40 +15,107 @@ type PageID int64
 
 // ======================================================================
 
+// ページ0はスーパーブロック専用で、FreeListの先頭ページを指し示す
+const (
+	superblockPageID         = PageID(0)
+	superblockMagic   uint32 = 0x43444230 // "CDB0"
+	superblockVersion uint16 = 1
+)
+
+// ページ0（スーパーブロック）のレイアウト: magic(4) + version(2) + freeListHead(8)
+func readSuperblock(buf []byte) (freeListHead PageID, err error) {
+	magic := binary.LittleEndian.Uint32(buf[0:4])
+	version := binary.LittleEndian.Uint16(buf[4:6])
+
+	if magic != superblockMagic {
+		return InvalidID, fmt.Errorf("corrupt superblock: bad magic %x", magic)
+	}
+	if version != superblockVersion {
+		return InvalidID, fmt.Errorf("unsupported superblock version: %d", version)
+	}
+
+	return PageID(binary.LittleEndian.Uint64(buf[6:14])), nil
+}
+
+func writeSuperblock(freeListHead PageID) []byte {
+	buf := make([]byte, PageSize)
+	binary.LittleEndian.PutUint32(buf[0:4], superblockMagic)
+	binary.LittleEndian.PutUint16(buf[4:6], superblockVersion)
+	binary.LittleEndian.PutUint64(buf[6:14], uint64(freeListHead))
+	return buf
+}
+
+// ======================================================================
+
 type FileManager struct {
-	heap   *os.File
-	nextID PageID
+	storage Storage
+	nextID  PageID
+
+	freeList      *FreeList
+	freeListPages []PageID // 現在ディスク上にあるフリーリスト自身の連結ページ（Close時に使い回す）
 }
 
+// pathのOSファイルをStorageとして使うFileManagerを作る
 func NewFileManager(path string) (*FileManager, error) {
-	// ファイル準備
-	heap, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0755)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_SYNC, 0755)
 	if err != nil {
 		return nil, err
 	}
 
+	return NewFileManagerFromStorage(newOSStorage(file))
+}
+
+// 任意のStorageの上にFileManagerを作る。OSファイル以外（テスト用のMemStorageなど）を
+// 使いたい場合はこちらを呼ぶ
+func NewFileManagerFromStorage(storage Storage) (*FileManager, error) {
 	// サイズ確保＆サイズチェック
-	info, err := heap.Stat()
+	heapSize, err := storage.Size()
 	if err != nil {
 		return nil, err
 	}
-	heapSize := info.Size()
 	if heapSize%PageSize != 0 {
 		return nil, fmt.Errorf("invalid heap file size: got %d", heapSize)
 	}
 
-	nextID := PageID(heapSize) / PageSize
-	if nextID <= InvalidID {
-		return nil, fmt.Errorf("invalid page id: got %d", nextID)
+	m := &FileManager{
+		storage:  newPagePaddedStorage(storage),
+		freeList: newFreeList(),
+	}
+
+	if heapSize == 0 {
+		// 新規ファイル: ページ0をスーパーブロックとして予約し、次に割り当てるページは1から始まる
+		m.nextID = 1
+		if err := m.WritePageData(superblockPageID, writeSuperblock(InvalidID)); err != nil {
+			return nil, err
+		}
+		return m, nil
+	}
+
+	m.nextID = PageID(heapSize) / PageSize
+	if m.nextID <= InvalidID {
+		return nil, fmt.Errorf("invalid page id: got %d", m.nextID)
+	}
+
+	buf := make([]byte, PageSize)
+	if err := m.ReadPageData(superblockPageID, buf); err != nil {
+		return nil, err
+	}
+	freeListHead, err := readSuperblock(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, chainPages, err := m.readFreeListChain(freeListHead)
+	if err != nil {
+		return nil, err
 	}
+	m.freeList.ids = ids
+	m.freeListPages = chainPages
 
-	return &FileManager{
-		heap:   heap,
-		nextID: nextID,
-	}, nil
+	return m, nil
 }
 
-func (m *FileManager) checkSeek(pageID PageID, pageData []byte) error {
+func (m *FileManager) checkPage(pageID PageID, pageData []byte) error {
 	// ページサイズチェック
 	if len(pageData) != PageSize {
 		return fmt.Errorf("invalid page size: got %d, want %d", len(pageData), PageSize)
@@ -59,22 +126,16 @@ func (m *FileManager) checkSeek(pageID PageID, pageData []byte) error {
 		return fmt.Errorf("invalid page id: got %d", pageID)
 	}
 
-	// ファイルシーク
-	if _, err := m.heap.Seek(int64(pageID*PageSize), io.SeekStart); err != nil {
-		return fmt.Errorf("failed to seek page data: %w", err)
-	}
-
 	return nil
 }
 
 // ページデータ読み込み
 func (m *FileManager) ReadPageData(pageID PageID, pageData []byte) error {
-	if err := m.checkSeek(pageID, pageData); err != nil {
+	if err := m.checkPage(pageID, pageData); err != nil {
 		return err
 	}
 
-	// ファイル読み込み
-	if _, err := m.heap.Read(pageData); err != nil {
+	if _, err := m.storage.ReadAt(pageData, int64(pageID)*PageSize); err != nil {
 		return fmt.Errorf("failed to read page data: %w", err)
 	}
 
@@ -83,31 +144,59 @@ func (m *FileManager) ReadPageData(pageID PageID, pageData []byte) error {
 
 // ページデータ書き込み
 func (m *FileManager) WritePageData(pageID PageID, pageData []byte) error {
-	if err := m.checkSeek(pageID, pageData); err != nil {
+	if err := m.checkPage(pageID, pageData); err != nil {
 		return err
 	}
 
-	// ファイル書き込み
-	if _, err := m.heap.Write(pageData); err != nil {
+	if _, err := m.storage.WriteAt(pageData, int64(pageID)*PageSize); err != nil {
 		return fmt.Errorf("failed to write page data: %w", err)
 	}
 
 	return nil
 }
 
-// ページ割り当て
+// ページ割り当て。フリーリストに再利用可能なページがあればそれを優先して返し、
+// 無ければヒープの末尾に新しいページを積み増す
 func (m *FileManager) AllocateNewPage() (PageID, error) {
+	if pageID, ok := m.freeList.pop(); ok {
+		return pageID, nil
+	}
+
 	pageID := m.nextID
 	m.nextID++
 	return pageID, nil
 }
 
+// ページを解放し、以降のAllocateNewPageで再利用できるようにする
+func (m *FileManager) FreePage(pageID PageID) error {
+	if pageID <= InvalidID || pageID >= m.nextID {
+		return fmt.Errorf("invalid page id: got %d", pageID)
+	}
+	if pageID == superblockPageID {
+		return fmt.Errorf("cannot free the superblock page")
+	}
+
+	m.freeList.push(pageID)
+	return nil
+}
+
 // ファイル同期
 func (m *FileManager) Sync() error {
-	return m.heap.Sync()
+	return m.storage.Sync()
 }
 
-// ファイルクローズ
+// フリーリストをディスクに書き戻してからファイルを閉じる
 func (m *FileManager) Close() error {
-	return m.heap.Close()
+	// 古いフリーリスト自身が使っていたページも、解放済みページとして一緒に書き戻す
+	allIDs := append(m.freeList.ids, m.freeListPages...)
+
+	head, err := m.writeFreeListChain(allIDs)
+	if err != nil {
+		return err
+	}
+	if err := m.WritePageData(superblockPageID, writeSuperblock(head)); err != nil {
+		return err
+	}
+
+	return m.storage.Close()
 }
@@ -0,0 +1,132 @@
+package disk
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// ======================================================================
+
+// フリーリストページ1枚のヘッダーサイズ（次のフリーリストページへのポインタ8bytes + 件数2bytes）
+const freeListHeaderSize = 8 + 2
+
+// フリーリストページ1枚に収められるページID数
+const freeListCapacity = (PageSize - freeListHeaderSize) / 8
+
+// 解放済みで再利用可能なページIDの集合。メモリ上ではただのスタックとして扱い、
+// ディスク上ではスーパーブロックが指す先頭ページから辿れる連結リストとして永続化する
+type FreeList struct {
+	ids []PageID
+}
+
+func newFreeList() *FreeList {
+	return &FreeList{}
+}
+
+// idを再利用可能な状態に戻す
+func (fl *FreeList) push(id PageID) {
+	fl.ids = append(fl.ids, id)
+}
+
+// 再利用可能なページIDを1つ取り出す。無ければfalseを返す
+func (fl *FreeList) pop() (PageID, bool) {
+	n := len(fl.ids)
+	if n == 0 {
+		return InvalidID, false
+	}
+	id := fl.ids[n-1]
+	fl.ids = fl.ids[:n-1]
+	return id, true
+}
+
+// 現在プールされている再利用可能なページ数
+func (fl *FreeList) Len() int {
+	return len(fl.ids)
+}
+
+// ======================================================================
+
+// headから辿れるフリーリストの連結ページを読み込み、格納されているページID群と、
+// 連結リスト自身が使っているページID群(次回書き直す際に再利用できる)を返す。
+// 循環参照や範囲外のIDが見つかった場合は壊れたフリーリストとして扱う
+func (m *FileManager) readFreeListChain(head PageID) (ids []PageID, chainPages []PageID, err error) {
+	visited := make(map[PageID]bool)
+	buf := make([]byte, PageSize)
+
+	cur := head
+	for cur != InvalidID {
+		if visited[cur] {
+			return nil, nil, fmt.Errorf("corrupt freelist: cycle at page %d", cur)
+		}
+		if cur <= InvalidID || cur >= m.nextID {
+			return nil, nil, fmt.Errorf("corrupt freelist: out-of-range page id %d", cur)
+		}
+		visited[cur] = true
+		chainPages = append(chainPages, cur)
+
+		if err := m.ReadPageData(cur, buf); err != nil {
+			return nil, nil, err
+		}
+
+		next := PageID(binary.LittleEndian.Uint64(buf[0:8]))
+		count := binary.LittleEndian.Uint16(buf[8:10])
+		if int(count) > freeListCapacity {
+			return nil, nil, fmt.Errorf("corrupt freelist: invalid entry count %d at page %d", count, cur)
+		}
+		for i := 0; i < int(count); i++ {
+			off := freeListHeaderSize + i*8
+			id := PageID(binary.LittleEndian.Uint64(buf[off:off+8]))
+			if id <= InvalidID || id >= m.nextID {
+				return nil, nil, fmt.Errorf("corrupt freelist: out-of-range page id %d at page %d", id, cur)
+			}
+			ids = append(ids, id)
+		}
+
+		cur = next
+	}
+
+	return ids, chainPages, nil
+}
+
+// idsを新しいフリーリストのページ群として書き出し、連結リストの先頭ページIDを返す。
+// 各ページ自身の格納先も末尾からidsを1つずつ取って使い回すため、渡されたids以外のページを
+// 新たに確保することはなく、ヒープは伸びない
+func (m *FileManager) writeFreeListChain(ids []PageID) (PageID, error) {
+	if len(ids) == 0 {
+		return InvalidID, nil
+	}
+
+	head := InvalidID
+	buf := make([]byte, PageSize)
+	remaining := ids
+
+	for len(remaining) > 0 {
+		pageID := remaining[len(remaining)-1]
+		remaining = remaining[:len(remaining)-1]
+
+		end := freeListCapacity
+		if end > len(remaining) {
+			end = len(remaining)
+		}
+		chunk := remaining[:end]
+		remaining = remaining[end:]
+
+		for i := range buf {
+			buf[i] = 0
+		}
+		binary.LittleEndian.PutUint64(buf[0:8], uint64(head))
+		binary.LittleEndian.PutUint16(buf[8:10], uint16(len(chunk)))
+		for i, id := range chunk {
+			off := freeListHeaderSize + i*8
+			binary.LittleEndian.PutUint64(buf[off:off+8], uint64(id))
+		}
+
+		if err := m.WritePageData(pageID, buf); err != nil {
+			return InvalidID, err
+		}
+
+		head = pageID
+	}
+
+	return head, nil
+}
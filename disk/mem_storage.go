@@ -0,0 +1,82 @@
+package disk
+
+import (
+	"fmt"
+	"sync"
+)
+
+// テスト用のインメモリStorage実装。ファイルシステムを介さずにFileManagerを動かせる
+type MemStorage struct {
+	mu   sync.RWMutex
+	data []byte
+}
+
+func NewMemStorage() *MemStorage {
+	return &MemStorage{}
+}
+
+func (s *MemStorage) ReadAt(b []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if off < 0 || off+int64(len(b)) > int64(len(s.data)) {
+		return 0, fmt.Errorf("read out of range: offset %d, length %d, size %d", off, len(b), len(s.data))
+	}
+
+	return copy(b, s.data[off:off+int64(len(b))]), nil
+}
+
+func (s *MemStorage) WriteAt(b []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if off < 0 {
+		return 0, fmt.Errorf("write out of range: offset %d", off)
+	}
+
+	end := off + int64(len(b))
+	if end > int64(len(s.data)) {
+		if end <= int64(cap(s.data)) {
+			s.data = s.data[:end]
+		} else {
+			grown := make([]byte, end, end*2)
+			copy(grown, s.data)
+			s.data = grown
+		}
+	}
+
+	return copy(s.data[off:end], b), nil
+}
+
+func (s *MemStorage) Sync() error {
+	return nil
+}
+
+func (s *MemStorage) Size() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return int64(len(s.data)), nil
+}
+
+func (s *MemStorage) Truncate(size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size < 0 {
+		return fmt.Errorf("invalid size: got %d", size)
+	}
+	if int64(len(s.data)) == size {
+		return nil
+	}
+
+	grown := make([]byte, size)
+	copy(grown, s.data)
+	s.data = grown
+
+	return nil
+}
+
+func (s *MemStorage) Close() error {
+	return nil
+}
@@ -0,0 +1,100 @@
+package disk
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// ======================================================================
+
+// ページの実データをどこに読み書きするかを抽象化するインターフェース。
+// FileManagerはこれを通してのみ読み書きするため、OSファイル以外のバックエンド
+// （テスト用のインメモリ実装や、将来のリモート/オブジェクトストレージ）に差し替えられる
+type Storage interface {
+	io.ReaderAt
+	io.WriterAt
+	Sync() error
+	Size() (int64, error)
+	Truncate(size int64) error
+	Close() error
+}
+
+// ======================================================================
+
+// 通常のOSファイルをStorageとして使うための実装
+type osStorage struct {
+	file *os.File
+}
+
+func newOSStorage(file *os.File) *osStorage {
+	return &osStorage{file: file}
+}
+
+func (s *osStorage) ReadAt(b []byte, off int64) (int, error) {
+	return s.file.ReadAt(b, off)
+}
+
+func (s *osStorage) WriteAt(b []byte, off int64) (int, error) {
+	return s.file.WriteAt(b, off)
+}
+
+func (s *osStorage) Sync() error {
+	return s.file.Sync()
+}
+
+func (s *osStorage) Size() (int64, error) {
+	info, err := s.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (s *osStorage) Truncate(size int64) error {
+	return s.file.Truncate(size)
+}
+
+func (s *osStorage) Close() error {
+	return s.file.Close()
+}
+
+// ======================================================================
+
+// 書き込みのたびに、内側のStorageのサイズをPageSizeの倍数へ切り上げる薄いラッパー。
+// ページはいつも揃った単位で書き込むはずだが、ストレージ実装側の挙動に関わらず
+// 末尾が常にページ境界に揃っていることを保証する
+type pagePaddedStorage struct {
+	Storage
+	mu sync.Mutex // WriteAt内のwrite→Size→Truncateを1つの操作として直列化する
+}
+
+func newPagePaddedStorage(s Storage) *pagePaddedStorage {
+	return &pagePaddedStorage{Storage: s}
+}
+
+func (p *pagePaddedStorage) WriteAt(b []byte, off int64) (int, error) {
+	// write→Size→Truncateを別々にロックする内側のStorageに任せると、並行な
+	// WriteAt同士がこの3手順の間で入り乱れ、片方のTruncateがもう片方の書き込みを
+	// 巻き戻してしまう。ここで一連の操作全体を直列化して、それを防ぐ
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n, err := p.Storage.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+
+	size, err := p.Storage.Size()
+	if err != nil {
+		return n, err
+	}
+	if rem := size % PageSize; rem != 0 {
+		if err := p.Storage.Truncate(size - rem + PageSize); err != nil {
+			return n, fmt.Errorf("failed to pad storage to a page boundary: %w", err)
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,461 @@
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/yuya-isaka/chibidb/disk"
+)
+
+// バックグラウンドフラッシャーがダーティなフレームを書き戻しに回る間隔
+const backgroundFlushInterval = 50 * time.Millisecond
+
+// ======================================================================
+
+// フレームへの参照数（ピンカウント）
+type Pin int64
+
+// フレームが空、または誰からも参照されていないことを表す初期値
+const NoReferencePin Pin = -1
+
+// ======================================================================
+
+// バッファプールの1フレーム分のデータ
+type frame struct {
+	pageID   disk.PageID
+	data     []byte
+	pinCount Pin
+	isUpdate bool // ディスクへの書き戻しが必要かどうか
+}
+
+func newFrame() *frame {
+	return &frame{
+		pageID:   disk.InvalidID,
+		data:     make([]byte, disk.PageSize),
+		pinCount: NoReferencePin,
+		isUpdate: false,
+	}
+}
+
+// ======================================================================
+
+// 固定数のフレームを持つバッファプール本体
+type Pool struct {
+	frames []*frame
+}
+
+// sizeフレーム分のバッファプールを作成する。全フレームは最初、未使用＝参照なし状態
+func NewPool(size int) *Pool {
+	frames := make([]*frame, size)
+	for i := range frames {
+		frames[i] = newFrame()
+	}
+
+	return &Pool{frames: frames}
+}
+
+// ======================================================================
+
+// フレームへのハンドル。呼び出し側はこれを通してページデータを読み書きする。
+// pinCount/isUpdateはバックグラウンドフラッシャーもm.muを握った上で読むため、
+// ここでも同じmuを握ってから触る
+type Page struct {
+	frame *frame
+	mu    *sync.Mutex
+}
+
+func (p *Page) GetData() []byte {
+	return p.frame.data
+}
+
+func (p *Page) SetData(data []byte) {
+	copy(p.frame.data, data)
+}
+
+// ディスクへの書き戻しが必要かどうかをセットする
+func (p *Page) SetUpdate(isUpdate bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.frame.isUpdate = isUpdate
+}
+
+// 参照カウンタを1減らす
+func (p *Page) SubPin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.frame.pinCount--
+}
+
+func (p *Page) GetPinCount() Pin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.frame.pinCount
+}
+
+// ======================================================================
+
+// バッファプールとディスクの仲介をする
+type PoolManager struct {
+	mu          sync.Mutex
+	fileManager *disk.FileManager
+	pool        *Pool
+	pageTable   map[disk.PageID]int // pageID -> フレームのインデックス
+	replacer    Replacer
+
+	closed      bool
+	stopFlusher chan struct{}
+	flusherDone chan struct{}
+	flushErr    error // バックグラウンドフラッシャーが書き戻しに失敗した場合、最後のエラーを覚えておく
+
+	// ======================================================================
+	// txパッケージがコピーオンライトのトランザクションを組み立てるための最小限の土台。
+	// PoolManager自身はトランザクションの意味（COWやコミット手順）を知らない
+
+	writeMu  sync.Mutex // 書き込みトランザクションは常に1つまで
+	txMu     sync.Mutex
+	nextTxID uint64
+	readTxs  map[uint64]struct{} // 現在開いている読み取りトランザクションのID集合
+
+	pendingMu sync.Mutex
+	pending   []pendingFree // コミット済みだが、まだ読み取りトランザクションから見えている可能性がある古いページ
+}
+
+type pendingFree struct {
+	watermark uint64 // このページを解放したコミットの直後に発行されたトランザクションID
+	pageID    disk.PageID
+}
+
+// デフォルトではCLOCK（セカンドチャンス）方式のReplacerを使う
+func NewPoolManager(fileManager *disk.FileManager, pool *Pool) *PoolManager {
+	return NewPoolManagerWithReplacer(fileManager, pool, NewClockReplacer(len(pool.frames)))
+}
+
+// 追い出し方針を選んでPoolManagerを作る（例: NewLRUKReplacer(2)）
+func NewPoolManagerWithReplacer(fileManager *disk.FileManager, pool *Pool, replacer Replacer) *PoolManager {
+	m := &PoolManager{
+		fileManager: fileManager,
+		pool:        pool,
+		pageTable:   make(map[disk.PageID]int),
+		replacer:    replacer,
+		readTxs:     make(map[uint64]struct{}),
+		stopFlusher: make(chan struct{}),
+		flusherDone: make(chan struct{}),
+	}
+
+	go m.backgroundFlush()
+
+	return m
+}
+
+// 参照されていないフレーム（pinCount < 0）の中から、Replacerに追い出す1つを選ばせる
+func (m *PoolManager) findVictim() (int, error) {
+	var candidates []int
+	for i, f := range m.pool.frames {
+		if f.pinCount < 0 {
+			candidates = append(candidates, i)
+		}
+	}
+
+	frameIdx, ok := m.replacer.Victim(candidates)
+	if !ok {
+		return 0, fmt.Errorf("no free frame: all frames are pinned")
+	}
+
+	return frameIdx, nil
+}
+
+// フレームが既に別のページを保持していた場合、ダーティなら書き戻してからページテーブルを更新する
+func (m *PoolManager) evict(frameIdx int) error {
+	f := m.pool.frames[frameIdx]
+
+	if f.pageID == disk.InvalidID {
+		return nil
+	}
+
+	if f.isUpdate {
+		if err := m.fileManager.WritePageData(f.pageID, f.data); err != nil {
+			return err
+		}
+	}
+
+	delete(m.pageTable, f.pageID)
+	m.replacer.Remove(frameIdx)
+
+	return nil
+}
+
+// 新しいページを確保し、空いているフレームに割り当てる
+func (m *PoolManager) CreatePage() (disk.PageID, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	frameIdx, err := m.findVictim()
+	if err != nil {
+		return disk.InvalidID, err
+	}
+
+	if err := m.evict(frameIdx); err != nil {
+		return disk.InvalidID, err
+	}
+
+	pageID, err := m.fileManager.AllocateNewPage()
+	if err != nil {
+		return disk.InvalidID, err
+	}
+
+	f := m.pool.frames[frameIdx]
+	f.pageID = pageID
+	for i := range f.data {
+		f.data[i] = 0
+	}
+	f.isUpdate = false
+	f.pinCount = NoReferencePin
+
+	m.pageTable[pageID] = frameIdx
+	m.replacer.RecordAccess(frameIdx)
+
+	return pageID, nil
+}
+
+// ページをバッファプールに読み込み、参照カウンタを1増やして返す
+func (m *PoolManager) FetchPage(pageID disk.PageID) (*Page, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if frameIdx, ok := m.pageTable[pageID]; ok {
+		f := m.pool.frames[frameIdx]
+		f.pinCount++
+		m.replacer.RecordAccess(frameIdx)
+		return &Page{frame: f, mu: &m.mu}, nil
+	}
+
+	frameIdx, err := m.findVictim()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.evict(frameIdx); err != nil {
+		return nil, err
+	}
+
+	f := m.pool.frames[frameIdx]
+	if err := m.fileManager.ReadPageData(pageID, f.data); err != nil {
+		return nil, err
+	}
+	f.pageID = pageID
+	f.isUpdate = false
+	f.pinCount = NoReferencePin
+
+	m.pageTable[pageID] = frameIdx
+	f.pinCount++
+	m.replacer.RecordAccess(frameIdx)
+
+	return &Page{frame: f, mu: &m.mu}, nil
+}
+
+// ページを解放し、ディスク上のフリーリストに戻す。キャッシュされていた場合はフレームも無効化し、
+// 書き戻されないようにする
+func (m *PoolManager) FreePage(pageID disk.PageID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if frameIdx, ok := m.pageTable[pageID]; ok {
+		f := m.pool.frames[frameIdx]
+		f.isUpdate = false
+		f.pageID = disk.InvalidID
+		f.pinCount = NoReferencePin
+		delete(m.pageTable, pageID)
+		m.replacer.Remove(frameIdx)
+	}
+
+	return m.fileManager.FreePage(pageID)
+}
+
+// ダーティなフレームを書き戻す。onlyUnpinnedがtrueなら、ピンされているフレーム
+// （今まさに触られている最中かもしれないもの）には手を出さない。呼び出し側がmuを
+// 握っていること
+func (m *PoolManager) flushFrames(onlyUnpinned bool) error {
+	for _, f := range m.pool.frames {
+		if f.pageID == disk.InvalidID || !f.isUpdate {
+			continue
+		}
+		if onlyUnpinned && f.pinCount >= 0 {
+			continue
+		}
+		if err := m.fileManager.WritePageData(f.pageID, f.data); err != nil {
+			return err
+		}
+		f.isUpdate = false
+	}
+
+	return nil
+}
+
+// 一定間隔でダーティかつピンされていないフレームを書き戻すバックグラウンドゴルーチン。
+// Close()がstopFlusherを閉じるまで動き続ける。書き戻しに失敗した場合は直ちに
+// リトライしても状況は変わらないことが多いので、最後のエラーを覚えておき
+// Flush()が呼ばれたタイミングで気づけるようにする。Close()はこのエラーを見ず、
+// 全フレームを改めて書き戻した結果だけを返す
+func (m *PoolManager) backgroundFlush() {
+	defer close(m.flusherDone)
+
+	ticker := time.NewTicker(backgroundFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stopFlusher:
+			return
+		case <-ticker.C:
+			m.mu.Lock()
+			err := m.flushFrames(true)
+			if err != nil {
+				m.flushErr = err
+			}
+			m.mu.Unlock()
+		}
+	}
+}
+
+// ダーティなフレームを全て書き戻し、ディスクに同期する（ファイルはClose()と違い開いたまま）
+func (m *PoolManager) Flush() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// バックグラウンドフラッシャーが既に書き込みエラーを起こしていたら、まずそれを
+	// 呼び出し側に伝える（古いエラーとして握りつぶさない）
+	if m.flushErr != nil {
+		err := m.flushErr
+		m.flushErr = nil
+		return err
+	}
+
+	if err := m.flushFrames(false); err != nil {
+		return err
+	}
+
+	return m.fileManager.Sync()
+}
+
+// ======================================================================
+// txパッケージ向けの土台。PoolManager自身はトランザクションの意味を知らず、
+// 「書き込みは1つまで」「読み取りトランザクションの生存期間」を追跡するだけ
+
+// 書き込みトランザクションのロックを取得する。他の書き込みトランザクションが
+// 終わるまでブロックする
+func (m *PoolManager) LockWriter() {
+	m.writeMu.Lock()
+}
+
+// 書き込みトランザクションのロックを手放す
+func (m *PoolManager) UnlockWriter() {
+	m.writeMu.Unlock()
+}
+
+// トランザクションIDを1つ新しく発行する。IDは発行された順に単調増加する
+func (m *PoolManager) NextTxID() uint64 {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.nextTxID++
+	return m.nextTxID
+}
+
+// 読み取りトランザクションの開始を登録する
+func (m *PoolManager) BeginReadTx(id uint64) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.readTxs[id] = struct{}{}
+}
+
+// 読み取りトランザクションの終了を登録し、解放待ちになっているページの中で
+// もう参照されうるものが無くなったものを実際にフリーリストへ返す
+func (m *PoolManager) EndReadTx(id uint64) error {
+	m.txMu.Lock()
+	delete(m.readTxs, id)
+	m.txMu.Unlock()
+
+	return m.ReclaimFreed()
+}
+
+// 現在開いている読み取りトランザクションの中で最小のIDを返す。1つも無ければfalse
+func (m *PoolManager) MinOpenReadTxID() (uint64, bool) {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	min, ok := uint64(0), false
+	for id := range m.readTxs {
+		if !ok || id < min {
+			min, ok = id, true
+		}
+	}
+	return min, ok
+}
+
+// あるコミットで古くなったページを、その直後に発行されたトランザクションID（watermark）と
+// 紐付けて解放待ちにする。watermarkより前に開始した読み取りトランザクションが残っている間は、
+// まだ古い版を見ている可能性があるため実際には解放しない
+func (m *PoolManager) QueueFree(watermark uint64, pageID disk.PageID) {
+	m.pendingMu.Lock()
+	defer m.pendingMu.Unlock()
+
+	m.pending = append(m.pending, pendingFree{watermark: watermark, pageID: pageID})
+}
+
+// 解放待ちのページのうち、もう参照されうる読み取りトランザクションが無いものを
+// フリーリストへ返す
+func (m *PoolManager) ReclaimFreed() error {
+	m.pendingMu.Lock()
+	minID, hasReader := m.MinOpenReadTxID()
+
+	var remain []pendingFree
+	var toFree []disk.PageID
+	for _, p := range m.pending {
+		if hasReader && minID <= p.watermark {
+			remain = append(remain, p)
+			continue
+		}
+		toFree = append(toFree, p.pageID)
+	}
+	m.pending = remain
+	m.pendingMu.Unlock()
+
+	for _, pageID := range toFree {
+		if err := m.FreePage(pageID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ダーティなフレームを全て書き戻してからファイルを閉じる。2回目以降の呼び出しはエラーを返す
+func (m *PoolManager) Close() error {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return fmt.Errorf("pool manager already closed")
+	}
+	m.closed = true
+	m.mu.Unlock()
+
+	// ミューテックスを取ったままバックグラウンドフラッシャーを止めようとすると、
+	// flushFramesを呼ぶためにロック待ちしているフラッシャーがいつまでもstopFlusherを
+	// 見に行けずデッドロックするので、一度ロックを手放してから止める
+	close(m.stopFlusher)
+	<-m.flusherDone
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.flushFrames(false); err != nil {
+		return err
+	}
+
+	return m.fileManager.Close()
+}
@@ -1,8 +1,8 @@
 package pool_test
 
 import (
-	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/yuya-isaka/chibidb/disk"
@@ -41,11 +41,9 @@ func TestPool(t *testing.T) {
 	// ------------------------------------------------------------------
 
 	t.Run("Simple Pool 3", func(t *testing.T) {
-		// テストファイル準備
-		testFile := "testfile"
-		fileManager, err := disk.NewFileManager(testFile)
+		// ファイルマネージャ準備（テストなのでインメモリストレージを使う）
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
 		assert.NoError(err)
-		defer os.Remove(testFile)
 
 		// プール準備
 		poolTest := pool.NewPool(3)
@@ -63,16 +61,14 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetData())
 	})
 
 	t.Run("Complex Pool 3", func(t *testing.T) {
-		// テストファイル準備
-		testFile := "testfile"
-		fileManager, err := disk.NewFileManager(testFile)
+		// ファイルマネージャ準備（テストなのでインメモリストレージを使う）
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
 		assert.NoError(err)
-		defer os.Remove(testFile)
 
 		// プール準備
 		poolTest := pool.NewPool(3)
@@ -90,7 +86,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -106,7 +102,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -116,16 +112,14 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetData())
 	})
 
 	t.Run("Pool 1", func(t *testing.T) {
-		// テストファイル準備
-		testFile := "testfile"
-		fileManager, err := disk.NewFileManager(testFile)
+		// ファイルマネージャ準備（テストなのでインメモリストレージを使う）
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
 		assert.NoError(err)
-		defer os.Remove(testFile)
 
 		// プール準備
 		poolTest := pool.NewPool(1)
@@ -143,7 +137,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -169,7 +163,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -184,7 +178,7 @@ func TestPool(t *testing.T) {
 		// ------------------------------------------------------------------
 
 		// helloIDはコピーされているので０のままのはず
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 
 		// helloが格納されているpageIDは変わらない
 		fetchPage, err = poolManager.FetchPage(helloID)
@@ -192,14 +186,25 @@ func TestPool(t *testing.T) {
 
 		// テスト (hello)
 		assert.Equal(helloBytes, fetchPage.GetData())
+		fetchPage.SubPin()
+
+		// ------------------------------------------------------------------
+
+		// フレームが1つしか無くても、ピンを外すたびにReplacer（CLOCK）が同じフレームを
+		// 何度でも追い出し先として選び直せることを確認する
+		prevID := helloID
+		for i := 0; i < 5; i++ {
+			newID, err := createPage(poolManager, worldBytes)
+			assert.NoError(err)
+			assert.NotEqual(prevID, newID)
+			prevID = newID
+		}
 	})
 
 	t.Run("Pool 2", func(t *testing.T) {
-		// テストファイル準備
-		testFile := "testfile"
-		fileManager, err := disk.NewFileManager(testFile)
+		// ファイルマネージャ準備（テストなのでインメモリストレージを使う）
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
 		assert.NoError(err)
-		defer os.Remove(testFile)
 
 		// プール準備
 		poolTest := pool.NewPool(2)
@@ -217,7 +222,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (hello)
-		assert.Equal(disk.PageID(0), helloID)
+		assert.Equal(disk.PageID(1), helloID)
 		assert.Equal(helloBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -231,7 +236,7 @@ func TestPool(t *testing.T) {
 		assert.NoError(err)
 
 		// テスト (world)
-		assert.Equal(disk.PageID(1), worldID)
+		assert.Equal(disk.PageID(2), worldID)
 		assert.Equal(worldBytes, fetchPage.GetData())
 
 		// ------------------------------------------------------------------
@@ -243,4 +248,30 @@ func TestPool(t *testing.T) {
 		// テスト (hello)
 		assert.Equal(helloBytes, fetchPage.GetData())
 	})
-}
\ No newline at end of file
+
+	t.Run("Background flusher persists dirty pages without an explicit Flush", func(t *testing.T) {
+		// ファイルマネージャ準備（テストなのでインメモリストレージを使う）
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
+		assert.NoError(err)
+
+		// プール準備
+		poolTest := pool.NewPool(2)
+		poolManager := pool.NewPoolManager(fileManager, poolTest)
+		defer poolManager.Close()
+
+		// ページをダーティにしたらすぐにピンを外す（バックグラウンドフラッシャーが
+		// 対象にするのは、ダーティかつピンされていないフレームだけのため）
+		helloID, err := createPage(poolManager, helloBytes)
+		assert.NoError(err)
+
+		// Flush()やClose()を呼ばずに、バックグラウンドフラッシャーが自力で
+		// ディスクへ書き戻すまで待つ
+		buf := make([]byte, disk.PageSize)
+		assert.Eventually(func() bool {
+			if err := fileManager.ReadPageData(helloID, buf); err != nil {
+				return false
+			}
+			return string(buf[:len(helloBytes)]) == string(helloBytes)
+		}, time.Second, 10*time.Millisecond)
+	})
+}
@@ -0,0 +1,150 @@
+package pool
+
+import "sync"
+
+// ======================================================================
+
+// ピンが外れているフレーム（候補）の中から、追い出すフレームを選ぶ方針。
+// PoolManagerは自身でpinCountを見て候補を絞り込み、その候補だけをReplacerに渡す。
+// Replacerはフレームがピンされているかどうかを知らず、アクセス履歴だけを管理する
+type Replacer interface {
+	// フレームがアクセスされたことを記録する（CreatePage/FetchPageの度に呼ばれる）
+	RecordAccess(frameIdx int)
+	// candidatesの中から追い出すフレームを1つ選ぶ。候補が無ければfalseを返す
+	Victim(candidates []int) (int, bool)
+	// フレームに関するアクセス履歴を破棄する（ページが解放され、フレームが再利用される前）
+	Remove(frameIdx int)
+}
+
+// ======================================================================
+
+// CLOCK方式（セカンドチャンス）のReplacer。各フレームに参照ビットを持ち、
+// 時計の針が指すフレームを順に見ていって、参照ビットが立っていれば下ろして次へ進み、
+// 立っていなければそれを追い出す
+type clockReplacer struct {
+	mu     sync.Mutex
+	refBit []bool
+	hand   int
+}
+
+func NewClockReplacer(size int) Replacer {
+	return &clockReplacer{refBit: make([]bool, size)}
+}
+
+func (c *clockReplacer) RecordAccess(frameIdx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refBit[frameIdx] = true
+}
+
+func (c *clockReplacer) Victim(candidates []int) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	inCandidates := make(map[int]bool, len(candidates))
+	for _, idx := range candidates {
+		inCandidates[idx] = true
+	}
+
+	n := len(c.refBit)
+	for i := 0; i < 2*n; i++ {
+		idx := c.hand
+		c.hand = (c.hand + 1) % n
+
+		if !inCandidates[idx] {
+			continue
+		}
+		if c.refBit[idx] {
+			// セカンドチャンス：参照ビットを下ろして針を先に進める
+			c.refBit[idx] = false
+			continue
+		}
+		return idx, true
+	}
+
+	// 候補全員の参照ビットが立っていた場合、ここまでで全員下ろし終えているので
+	// 最初の候補を追い出す
+	return candidates[0], true
+}
+
+func (c *clockReplacer) Remove(frameIdx int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.refBit[frameIdx] = false
+}
+
+// ======================================================================
+
+// LRU-K方式のReplacer。各フレームについて直近K回分のアクセス時刻を覚えておき、
+// K回分の履歴が無いフレーム（+∞扱い）を優先して追い出す。複数あれば最初のアクセスが
+// 一番古いものを選ぶ。K回分の履歴があるフレームしか残っていなければ、K回前の
+// アクセス時刻が一番古い（=後方K距離が一番大きい）ものを追い出す
+type lruKReplacer struct {
+	mu      sync.Mutex
+	k       int
+	counter uint64
+	history map[int][]uint64 // frameIdx -> 直近K回分のアクセス通し番号（古い順）
+}
+
+func NewLRUKReplacer(k int) Replacer {
+	return &lruKReplacer{k: k, history: make(map[int][]uint64)}
+}
+
+func (l *lruKReplacer) RecordAccess(frameIdx int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.counter++
+	hist := append(l.history[frameIdx], l.counter)
+	if len(hist) > l.k {
+		hist = hist[len(hist)-l.k:]
+	}
+	l.history[frameIdx] = hist
+}
+
+func (l *lruKReplacer) Victim(candidates []int) (int, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(candidates) == 0 {
+		return 0, false
+	}
+
+	victim := -1
+	victimInf := false
+	var victimOldest uint64
+
+	for _, frameIdx := range candidates {
+		hist := l.history[frameIdx]
+		inf := len(hist) < l.k
+		var oldest uint64
+		if len(hist) > 0 {
+			oldest = hist[0]
+		}
+
+		switch {
+		case victim == -1:
+			victim, victimInf, victimOldest = frameIdx, inf, oldest
+		case inf && !victimInf:
+			// +∞（履歴がK回未満）は常に優先して追い出す
+			victim, victimInf, victimOldest = frameIdx, inf, oldest
+		case inf == victimInf && oldest < victimOldest:
+			victim, victimInf, victimOldest = frameIdx, inf, oldest
+		}
+	}
+
+	return victim, true
+}
+
+func (l *lruKReplacer) Remove(frameIdx int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.history, frameIdx)
+}
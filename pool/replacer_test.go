@@ -0,0 +1,65 @@
+package pool_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+func TestClockReplacer(t *testing.T) {
+	assert := assert.New(t)
+
+	// フレームは3つあるが、候補（ピンが外れている）は0と2だけ
+	replacer := pool.NewClockReplacer(3)
+	replacer.RecordAccess(0)
+	replacer.RecordAccess(1)
+	replacer.RecordAccess(2)
+
+	// ------------------------------------------------------------------
+
+	// 候補が空なら追い出せない
+	_, ok := replacer.Victim(nil)
+	assert.False(ok)
+
+	// ------------------------------------------------------------------
+
+	// 参照ビットが立っている候補は一度スキップされ、2周目で追い出される
+	victim, ok := replacer.Victim([]int{0, 2})
+	assert.True(ok)
+	assert.Contains([]int{0, 2}, victim)
+
+	// 追い出したフレームの参照履歴を消すと、次に同じ候補を渡しても再度選べる
+	replacer.Remove(victim)
+	victim2, ok := replacer.Victim([]int{0, 2})
+	assert.True(ok)
+	assert.Contains([]int{0, 2}, victim2)
+}
+
+func TestLRUKReplacer(t *testing.T) {
+	assert := assert.New(t)
+
+	// K=2: 2回未満しかアクセスされていないフレームは+∞扱いで優先的に追い出される
+	replacer := pool.NewLRUKReplacer(2)
+
+	replacer.RecordAccess(0) // frame0: 1回
+	replacer.RecordAccess(1) // frame1: 1回目
+	replacer.RecordAccess(1) // frame1: 2回目（K回に達する）
+	replacer.RecordAccess(2) // frame2: 1回目
+	replacer.RecordAccess(2) // frame2: 2回目
+	replacer.RecordAccess(2) // frame2: 3回目（一番最近アクセスされた履歴を2つ保持）
+
+	// frame0だけがK回未満なので、候補に含まれていれば必ず追い出される
+	victim, ok := replacer.Victim([]int{0, 1, 2})
+	assert.True(ok)
+	assert.Equal(0, victim)
+
+	// ------------------------------------------------------------------
+
+	// 全員がK回分の履歴を持つ場合は、後方K距離が一番大きい（＝K回前のアクセスが
+	// 一番古い）フレームが追い出される。frame1はframe2よりアクセスされた回数が少なく
+	// 履歴も古いので、frame1が選ばれる
+	victim, ok = replacer.Victim([]int{1, 2})
+	assert.True(ok)
+	assert.Equal(1, victim)
+}
@@ -0,0 +1,222 @@
+// txは、pool.PoolManagerの上にコピーオンライトのトランザクション（Tx）を組み立てる。
+//
+// 現時点では、このパッケージはbtree.BTreeからは一切呼ばれていない。BTree.Insert/Search/
+// Delete/Clearはいまも直接pool.PoolManagerを介してページをインプレースで書き換えており、
+// Tx.Fetch/Tx.Putを経由していない。そのため「書き込みトランザクションはページを
+// インプレースで書き換えない」という保証は、BTreeを使う実際の呼び出し元には及んでいない。
+// Txは単体では一通り機能する（tx_test.goはこのパッケージ単体を直接叩いて検証している）が、
+// btree側の探索/分割/削除をTx.Fetch/Tx.Put越しに行うよう書き換える追従作業がまだ残っている
+package tx
+
+import (
+	"fmt"
+
+	"github.com/yuya-isaka/chibidb/btree"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/pool"
+)
+
+// ======================================================================
+
+// Txはバッファプールの上にコピーオンライトのトランザクションを組み立てる。
+// 書き込みトランザクションは常に1つまで（pool.PoolManagerの書き込みロックで直列化する）で、
+// 読み取りトランザクションはいくつでも同時に開ける。書き込みトランザクションはページを
+// インプレースで書き換えず、初めて触れたタイミングで新しいページにコピーしてから
+// pgid -> 新pgid の対応を覚えておき、以降のアクセスはそちらへリダイレクトする
+type Tx struct {
+	pm       *pool.PoolManager
+	writable bool
+	id       uint64
+	done     bool
+
+	remap map[disk.PageID]disk.PageID // 元のページID -> コピー済みの新しいページID（writableのみ）
+	pages map[disk.PageID]*pool.Page  // 新しいページID -> ピンを保持したままのハンドル（writableのみ）
+	freed []disk.PageID               // コピーによって古くなった元のページID（writableのみ）
+}
+
+// Beginはトランザクションを開始する。当初の想定はpool.PoolManager.Begin(writable bool)
+// というメソッドの形だったが、それだとpoolパッケージがtxパッケージをimportすることになり
+// 循環importになる。そのためbtree.NewBTree(poolManager)と同じく、コンストラクタ関数に
+// pool.PoolManagerを渡す形を取っている
+func Begin(pm *pool.PoolManager, writable bool) (*Tx, error) {
+	t := &Tx{
+		pm:       pm,
+		writable: writable,
+		id:       pm.NextTxID(),
+	}
+
+	if writable {
+		pm.LockWriter()
+		t.remap = make(map[disk.PageID]disk.PageID)
+		t.pages = make(map[disk.PageID]*pool.Page)
+	} else {
+		pm.BeginReadTx(t.id)
+	}
+
+	return t, nil
+}
+
+func (t *Tx) ID() uint64 {
+	return t.id
+}
+
+func (t *Tx) Writable() bool {
+	return t.writable
+}
+
+// ======================================================================
+
+// metaPageIDが指すメタページの、開始時点でのルートページIDを読み取る。
+// 読み取りトランザクションはBegin直後にこれを呼んで結果を覚えておくことで、
+// 以降に他の書き込みトランザクションがコミットしても自分のビューが変わらないようにする
+func (t *Tx) Snapshot(metaPageID disk.PageID) (disk.PageID, error) {
+	metaPage, err := t.pm.FetchPage(metaPageID)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+	defer metaPage.SubPin()
+
+	meta, err := btree.NewMeta(metaPage)
+	if err != nil {
+		return disk.InvalidID, err
+	}
+
+	return meta.GetRootID(), nil
+}
+
+// pageIDの現在の内容を読み取る。書き込みトランザクション内で既にPutされていれば
+// コピー先のページを返す。呼び出し側はSubPinでピンを戻すこと
+func (t *Tx) Fetch(pageID disk.PageID) (*pool.Page, error) {
+	if t.writable {
+		if newID, ok := t.remap[pageID]; ok {
+			pageID = newID
+		}
+	}
+	return t.pm.FetchPage(pageID)
+}
+
+// pageIDを書き込み用に取得する。このトランザクションで初めて触れるページなら
+// 新しいページを確保して内容をコピーし、以降は同じトランザクション内で同じコピー先を返す
+// （元のページをインプレースで書き換えることはしない）。戻り値の新しいページIDは、
+// 呼び出し側が親ノードの子ページIDなど参照元を更新するのに使う
+func (t *Tx) Put(pageID disk.PageID) (disk.PageID, *pool.Page, error) {
+	if !t.writable {
+		return disk.InvalidID, nil, fmt.Errorf("tx: read-only transaction cannot write")
+	}
+	if t.done {
+		return disk.InvalidID, nil, fmt.Errorf("tx: transaction already finished")
+	}
+
+	if newID, ok := t.remap[pageID]; ok {
+		return newID, t.pages[newID], nil
+	}
+
+	oldPage, err := t.pm.FetchPage(pageID)
+	if err != nil {
+		return disk.InvalidID, nil, err
+	}
+
+	newID, err := t.pm.CreatePage()
+	if err != nil {
+		oldPage.SubPin()
+		return disk.InvalidID, nil, err
+	}
+	newPage, err := t.pm.FetchPage(newID)
+	if err != nil {
+		oldPage.SubPin()
+		_ = t.pm.FreePage(newID) // CreatePageで確保済みなので、使わないなら解放してリークさせない
+		return disk.InvalidID, nil, err
+	}
+	newPage.SetData(oldPage.GetData())
+	newPage.SetUpdate(true)
+	oldPage.SubPin()
+
+	t.remap[pageID] = newID
+	t.pages[newID] = newPage
+	t.freed = append(t.freed, pageID)
+
+	return newID, newPage, nil
+}
+
+// ======================================================================
+
+// Commitは新しく作られたページを全て書き戻してfsyncし、metaPageIDが指すメタページの
+// ルートポインタをnewRootIDへ書き換えてから再度fsyncする。2回に分けてfsyncすることで、
+// クラッシュしてもルートポインタは新旧どちらか一方の完全な状態でしか観測されない
+// （WAL無しでのクラッシュ安全性）。コピーによって古くなった元のページは、まだそれを
+// 見ている可能性がある読み取りトランザクションが無くなるまでフリーリストへは戻さない
+func (t *Tx) Commit(metaPageID disk.PageID, newRootID disk.PageID) error {
+	if !t.writable {
+		return fmt.Errorf("tx: read-only transaction cannot commit")
+	}
+	if t.done {
+		return fmt.Errorf("tx: transaction already finished")
+	}
+
+	for _, p := range t.pages {
+		p.SetUpdate(true)
+	}
+	if err := t.pm.Flush(); err != nil {
+		return err
+	}
+
+	metaPage, err := t.pm.FetchPage(metaPageID)
+	if err != nil {
+		return err
+	}
+	meta, err := btree.NewMeta(metaPage)
+	if err != nil {
+		metaPage.SubPin()
+		return err
+	}
+	if err := meta.SetRootID(newRootID); err != nil {
+		metaPage.SubPin()
+		return err
+	}
+	metaPage.SetUpdate(true)
+	metaPage.SubPin()
+
+	if err := t.pm.Flush(); err != nil {
+		return err
+	}
+
+	// ここまで失敗せずに来たら後戻りはしない。失敗した場合はdoneを立てずに返すので、
+	// 呼び出し側はRollbackでコピーしたページのピンを戻し、フリーリストへ返せる
+	t.done = true
+	defer t.pm.UnlockWriter()
+
+	for _, p := range t.pages {
+		p.SubPin()
+	}
+
+	// watermark以降に発行されたトランザクションは、必ずこのコミット後のルートを見る
+	watermark := t.pm.NextTxID()
+	for _, pageID := range t.freed {
+		t.pm.QueueFree(watermark, pageID)
+	}
+
+	return t.pm.ReclaimFreed()
+}
+
+// Rollbackは書き込みトランザクションならコピーしたページを破棄してロックを手放し、
+// 読み取りトランザクションなら開いていた記録を消すだけでよい（何もコピーしていないため）
+func (t *Tx) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+
+	if !t.writable {
+		return t.pm.EndReadTx(t.id)
+	}
+	defer t.pm.UnlockWriter()
+
+	for newID, p := range t.pages {
+		p.SubPin()
+		if err := t.pm.FreePage(newID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
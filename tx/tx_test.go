@@ -0,0 +1,142 @@
+package tx_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/yuya-isaka/chibidb/btree"
+	"github.com/yuya-isaka/chibidb/disk"
+	"github.com/yuya-isaka/chibidb/pool"
+	"github.com/yuya-isaka/chibidb/tx"
+)
+
+// metaとrootのページを1組作り、メタページのルートポインタをrootに向けておく
+func createMetaRoot(poolManager *pool.PoolManager) (metaID, rootID disk.PageID, err error) {
+	metaID, err = poolManager.CreatePage()
+	if err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	metaPage, err := poolManager.FetchPage(metaID)
+	if err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	defer metaPage.SubPin()
+
+	rootID, err = poolManager.CreatePage()
+	if err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	rootPage, err := poolManager.FetchPage(rootID)
+	if err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	defer rootPage.SubPin()
+
+	meta, err := btree.NewMeta(metaPage)
+	if err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	if err := meta.SetRootID(rootID); err != nil {
+		return disk.InvalidID, disk.InvalidID, err
+	}
+	metaPage.SetUpdate(true)
+	rootPage.SetUpdate(true)
+
+	return metaID, rootID, nil
+}
+
+func TestTx(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("Commit swaps the root and keeps a reader's snapshot stable", func(t *testing.T) {
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
+		assert.NoError(err)
+
+		poolManager := pool.NewPoolManager(fileManager, pool.NewPool(8))
+		defer poolManager.Close()
+
+		metaID, rootID, err := createMetaRoot(poolManager)
+		assert.NoError(err)
+
+		// 読み取りトランザクションは開始時点のルートを覚えておく
+		rtx, err := tx.Begin(poolManager, false)
+		assert.NoError(err)
+		snapshot, err := rtx.Snapshot(metaID)
+		assert.NoError(err)
+		assert.Equal(rootID, snapshot)
+
+		// 書き込みトランザクションはインプレースで書き換えず、新しいページにコピーしてコミットする
+		wtx, err := tx.Begin(poolManager, true)
+		assert.NoError(err)
+		newRootID, newRootPage, err := wtx.Put(rootID)
+		assert.NoError(err)
+		assert.NotEqual(rootID, newRootID)
+		newRootPage.SetData(append([]byte("new root"), make([]byte, disk.PageSize-8)...))
+		assert.NoError(wtx.Commit(metaID, newRootID))
+
+		// コミット後、メタページは新しいルートを指す
+		after, err := rtx.Snapshot(metaID)
+		assert.NoError(err)
+		assert.Equal(newRootID, after)
+
+		// 読み取りトランザクションがまだ開いている間、元のルートページは書き換わっていない
+		oldPage, err := poolManager.FetchPage(rootID)
+		assert.NoError(err)
+		assert.NotEqual([]byte("new root"), oldPage.GetData()[:8])
+		oldPage.SubPin()
+
+		assert.NoError(rtx.Rollback())
+	})
+
+	t.Run("Rollback discards copied pages without touching the root", func(t *testing.T) {
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
+		assert.NoError(err)
+
+		poolManager := pool.NewPoolManager(fileManager, pool.NewPool(8))
+		defer poolManager.Close()
+
+		metaID, rootID, err := createMetaRoot(poolManager)
+		assert.NoError(err)
+
+		wtx, err := tx.Begin(poolManager, true)
+		assert.NoError(err)
+		_, _, err = wtx.Put(rootID)
+		assert.NoError(err)
+		assert.NoError(wtx.Rollback())
+
+		// 破棄されたので、メタページのルートは元のままのはず
+		rtx, err := tx.Begin(poolManager, false)
+		assert.NoError(err)
+		root, err := rtx.Snapshot(metaID)
+		assert.NoError(err)
+		assert.Equal(rootID, root)
+		assert.NoError(rtx.Rollback())
+	})
+
+	t.Run("A second write transaction blocks until the first finishes", func(t *testing.T) {
+		fileManager, err := disk.NewFileManagerFromStorage(disk.NewMemStorage())
+		assert.NoError(err)
+
+		poolManager := pool.NewPoolManager(fileManager, pool.NewPool(8))
+		defer poolManager.Close()
+
+		wtx1, err := tx.Begin(poolManager, true)
+		assert.NoError(err)
+
+		acquired := make(chan struct{})
+		go func() {
+			wtx2, _ := tx.Begin(poolManager, true)
+			close(acquired)
+			wtx2.Rollback()
+		}()
+
+		select {
+		case <-acquired:
+			t.Fatal("second writer acquired the lock while the first was still open")
+		default:
+		}
+
+		assert.NoError(wtx1.Rollback())
+		<-acquired
+	})
+}